@@ -0,0 +1,221 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenFile contains the tokens accepted by the controller, one per line,
+// optionally preceded by the identity of its owner, as in "ci s3cr3t". It is
+// read again when it changes, so it can be a mounted secret.
+type TokenFile struct {
+	sync.Mutex
+
+	path    string
+	modTime time.Time
+	size    int64
+	tokens  map[string]string
+}
+
+func NewTokenFile(path string) (*TokenFile, error) {
+	f := &TokenFile{path: path}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *TokenFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+
+	d, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+		case 1:
+			tokens[fields[0]] = "token"
+		case 2:
+			tokens[fields[1]] = fields[0]
+		default:
+			return fmt.Errorf("incorrect line in token file %s", f.path)
+		}
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("no tokens found in %s", f.path)
+	}
+	f.tokens = tokens
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// SetPath replaces the token file, tokens of the previous file are kept if the
+// new one cannot be read.
+func (f *TokenFile) SetPath(path string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	previousPath, previousModTime, previousSize := f.path, f.modTime, f.size
+	f.path, f.modTime, f.size = path, time.Time{}, 0
+	if err := f.load(); err != nil {
+		f.path, f.modTime, f.size = previousPath, previousModTime, previousSize
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the identity of the owner of the token, if valid
+func (f *TokenFile) Authenticate(token string) (string, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	// Previous tokens are kept if the file cannot be read
+	if err := f.load(); err != nil {
+		log.Printf("Couldn't read token file: %v\n", err)
+	}
+
+	identity, found := "", false
+	for t, id := range f.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			identity, found = id, true
+		}
+	}
+	return identity, found
+}
+
+// NewControlTLSConfig returns the TLS configuration for the controller,
+// client certificates are verified if clientCA is set. They are required
+// by the controller in all entry points but the ones used by probes, so they
+// cannot be required during the handshake.
+func NewControlTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if len(clientCA) > 0 {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Entry points used by probes, they don't require authentication nor client
+// certificates
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// auditResponseWriter keeps the status of the response for the audit log
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// requestIdentity returns the identity of the client from its certificate,
+// and from its token if tokens are required. Certificates are required in TLS
+// connections if clientCerts is set.
+func requestIdentity(req *http.Request, tokens *TokenFile, clientCerts bool) (string, bool) {
+	var identities []string
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		identities = append(identities, "cert:"+req.TLS.PeerCertificates[0].Subject.CommonName)
+	} else if req.TLS != nil && clientCerts && !probePaths[req.URL.Path] {
+		return "", false
+	}
+	if tokens != nil && !probePaths[req.URL.Path] {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return strings.Join(identities, ","), false
+		}
+		identity, ok := tokens.Authenticate(strings.TrimPrefix(auth, "Bearer "))
+		if !ok {
+			return strings.Join(identities, ","), false
+		}
+		identities = append(identities, "token:"+identity)
+	}
+	if len(identities) == 0 {
+		return "anonymous", true
+	}
+	return strings.Join(identities, ","), true
+}
+
+// audit authenticates requests if tokens or client certificates are required,
+// and logs a line for every request.
+func audit(handler http.Handler, tokens *TokenFile, clientCerts bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		identity, ok := requestIdentity(req, tokens, clientCerts)
+		if ok {
+			handler.ServeHTTP(aw, req)
+		} else {
+			aw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(aw, "Unauthorized\n", http.StatusUnauthorized)
+		}
+
+		remote := req.RemoteAddr
+		if len(remote) == 0 || remote == "@" {
+			remote = "unix"
+		}
+		if len(identity) == 0 {
+			identity = "unauthenticated"
+		}
+		log.Printf("Control request: %s %s from %s by %s: %d\n", req.Method, req.URL.RequestURI(), remote, identity, aw.status)
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(path, []byte("ci s3cr3t\nanother\n"), 0600)
+	tokens, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, ok := tokens.Authenticate("s3cr3t"); !ok || id != "ci" {
+		t.Fatalf("token should be valid for ci, found: %s (%v)", id, ok)
+	}
+	if id, ok := tokens.Authenticate("another"); !ok || id != "token" {
+		t.Fatalf("token without identity should be valid, found: %s (%v)", id, ok)
+	}
+	if _, ok := tokens.Authenticate("wrong"); ok {
+		t.Fatal("unknown token shouldn't be valid")
+	}
+
+	// Token file is read again when it changes
+	ioutil.WriteFile(path, []byte("ci n3w\n"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if _, ok := tokens.Authenticate("s3cr3t"); ok {
+		t.Fatal("old token shouldn't be valid after rotation")
+	}
+	if id, ok := tokens.Authenticate("n3w"); !ok || id != "ci" {
+		t.Fatalf("new token should be valid, found: %s (%v)", id, ok)
+	}
+}
+
+func TestAuditTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(path, []byte("ci s3cr3t\n"), 0600)
+	tokens, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := audit(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK\n"))
+	}), tokens, false)
+
+	cases := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic s3cr3t", http.StatusUnauthorized},
+		{"Bearer s3cr3t", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/reload", nil)
+		if len(c.auth) > 0 {
+			req.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%q: expected status %d, found %d", c.auth, c.status, w.Code)
+		}
+	}
+
+	// Without tokens, all requests are accepted
+	req := httptest.NewRequest("POST", "/reload", nil)
+	w := httptest.NewRecorder()
+	audit(http.NotFoundHandler(), nil, false).ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("request should reach the handler, found status %d", w.Code)
+	}
+}
+
+func TestAuditClientCerts(t *testing.T) {
+	handler := audit(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK\n"))
+	}), nil, true)
+
+	cases := []struct {
+		path   string
+		tls    bool
+		certs  []*x509.Certificate
+		status int
+	}{
+		{"/reload", true, nil, http.StatusUnauthorized},
+		{"/reload", true, []*x509.Certificate{{Subject: pkix.Name{CommonName: "ci"}}}, http.StatusOK},
+		{"/healthz", true, nil, http.StatusOK},
+		{"/readyz", true, nil, http.StatusOK},
+		// Unix sockets don't use TLS
+		{"/reload", false, nil, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", c.path, nil)
+		if c.tls {
+			req.TLS = &tls.ConnectionState{PeerCertificates: c.certs}
+		} else {
+			req.TLS = nil
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s (tls: %v, certs: %d): expected status %d, found %d", c.path, c.tls, len(c.certs), c.status, w.Code)
+		}
+	}
+}
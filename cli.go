@@ -0,0 +1,577 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit codes of client subcommands
+const (
+	exitOK = 0
+	// The operation was done but failed, e.g. invalid configuration
+	exitFailed = 1
+	exitUsage  = 2
+	// The controller couldn't be reached or rejected the request
+	exitUnavailable = 3
+)
+
+// ControlClient sends requests to the controller of a running wrapper
+type ControlClient struct {
+	client  *http.Client
+	baseURL string
+	token   string
+}
+
+// NewControlClient returns a client for a controller listening on address,
+// in the same format as -control-address. TLS is only used for TCP addresses,
+// if tlsConfig is set.
+func NewControlClient(address, token string, tlsConfig *tls.Config) (*ControlClient, error) {
+	l, err := ParseControlListener(address)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	baseURL := "http://" + l.Address
+	if l.Network == "unix" {
+		path := l.Address
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}
+		baseURL = "http://control"
+	} else if tlsConfig != nil {
+		baseURL = "https://" + l.Address
+	}
+	return &ControlClient{
+		client:  &http.Client{Transport: transport},
+		baseURL: baseURL,
+		token:   token,
+	}, nil
+}
+
+// Do sends a request to the controller, body can be nil
+func (c *ControlClient) Do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.client.Do(req)
+}
+
+// NewControlClientTLSConfig returns the TLS configuration to connect to
+// controllers served with TLS, clientCert and clientKey are optional.
+func NewControlClientTLSConfig(ca, clientCert, clientKey string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+		config.RootCAs = pool
+	}
+	if len(clientCert) > 0 {
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// clientCommand is a subcommand that talks to a running wrapper, flags adds
+// its own flags and returns the function that runs it.
+type clientCommand struct {
+	usage       string
+	description string
+	flags       func(fs *flag.FlagSet) func(cli *clientContext, args []string) int
+}
+
+var clientCommands = map[string]clientCommand{
+	"reload": {
+		usage:       "reload [-force] [-async] [-dry-run]",
+		description: "Reload haproxy configuration",
+		flags:       reloadCommand,
+	},
+	"validate": {
+		usage:       "validate [file]",
+		description: "Validate the running configuration, or the given file (- for standard input)",
+		flags:       validateCommand,
+	},
+	"status": {
+		usage:       "status",
+		description: "Show the status of the wrapper",
+		flags:       statusCommand,
+	},
+	"logs": {
+		usage:       "logs [-follow] [-n lines] [-source source] [-severity severity] [-contains text]",
+		description: "Show the last log lines of haproxy",
+		flags:       logsCommand,
+	},
+	"runtime": {
+		usage:       "runtime command",
+		description: "Send a command to haproxy runtime API, e.g. \"show servers state\"",
+		flags:       runtimeCommand,
+	},
+}
+
+// clientContext is passed to the client subcommands
+type clientContext struct {
+	client *ControlClient
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (cli *clientContext) errorf(code int, format string, args ...interface{}) int {
+	fmt.Fprintf(cli.stderr, format, args...)
+	return code
+}
+
+// do sends a request and fails with the body of the response if its status is
+// not one of the expected ones.
+func (cli *clientContext) do(method, path string, body io.Reader, expected ...int) (*http.Response, int) {
+	resp, err := cli.client.Do(method, path, body)
+	if err != nil {
+		return nil, cli.errorf(exitUnavailable, "Couldn't connect to the wrapper: %v\n", err)
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, exitOK
+		}
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	code := exitUnavailable
+	if resp.StatusCode == http.StatusBadGateway {
+		code = exitFailed
+	}
+	return nil, cli.errorf(code, "Request to %s failed: %s: %s\n", path, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// output writes v as JSON if requested, or in human-readable format otherwise
+func (cli *clientContext) output(v interface{}, human func(w io.Writer)) {
+	if cli.json {
+		encoder := json.NewEncoder(cli.stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(v)
+		return
+	}
+	human(cli.stdout)
+}
+
+// readClientToken reads the token to authenticate in the controller from a
+// file in the format of the controller token file, the token of its first
+// line is used, ignoring the identity that can precede it.
+func readClientToken(path string) (string, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+		case 1, 2:
+			return fields[len(fields)-1], nil
+		default:
+			return "", fmt.Errorf("incorrect line in token file %s", path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no token found in %s", path)
+}
+
+// runClient runs a client subcommand and returns its exit code
+func runClient(name string, args []string, stdout, stderr io.Writer) int {
+	command, found := clientCommands[name]
+	if !found {
+		fmt.Fprintf(stderr, "Unknown command: %s\n", name)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	address := fs.String("address", envDefault("HAPROXY_WRAPPER_ADDRESS", "127.0.0.1:15000"), "Address of the controller, as in -control-address, defaults to $HAPROXY_WRAPPER_ADDRESS")
+	tokenFile := fs.String("token-file", os.Getenv("HAPROXY_WRAPPER_TOKEN_FILE"), "File with the token to authenticate in the controller, in the format of -control-token-file, defaults to $HAPROXY_WRAPPER_TOKEN_FILE")
+	useTLS := fs.Bool("tls", false, "Connect to the controller with TLS")
+	tlsCA := fs.String("tls-ca", "", "CA to verify the certificate of the controller")
+	tlsCert := fs.String("tls-cert", "", "Client certificate")
+	tlsKey := fs.String("tls-key", "", "Key of the client certificate")
+	jsonOutput := fs.Bool("json", false, "Print JSON output")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s %s\n\n%s\n\nFlags:\n", os.Args[0], command.usage, command.description)
+		fs.PrintDefaults()
+	}
+	run := command.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	var token string
+	if len(*tokenFile) > 0 {
+		var err error
+		token, err = readClientToken(*tokenFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't read token: %v\n", err)
+			return exitUsage
+		}
+	}
+	var tlsConfig *tls.Config
+	if *useTLS || len(*tlsCA) > 0 || len(*tlsCert) > 0 {
+		var err error
+		tlsConfig, err = NewControlClientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(stderr, "Incorrect TLS configuration: %v\n", err)
+			return exitUsage
+		}
+	}
+	client, err := NewControlClient(*address, token, tlsConfig)
+	if err != nil {
+		fmt.Fprintf(stderr, "Incorrect address: %v\n", err)
+		return exitUsage
+	}
+
+	cli := &clientContext{
+		client: client,
+		json:   *jsonOutput,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	return run(cli, fs.Args())
+}
+
+// clientUsage prints the list of client subcommands
+func clientUsage(w io.Writer) {
+	var names []string
+	for name := range clientCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "\nCommands to control a running wrapper (see %s <command> -h):\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, clientCommands[name].description)
+	}
+}
+
+func envDefault(name, value string) string {
+	if v := os.Getenv(name); len(v) > 0 {
+		return v
+	}
+	return value
+}
+
+func reloadCommand(fs *flag.FlagSet) func(*clientContext, []string) int {
+	force := fs.Bool("force", false, "Reload even if the configuration hasn't changed")
+	async := fs.Bool("async", false, "Don't wait for the reload to finish, print the job instead")
+	dryRun := fs.Bool("dry-run", false, "Check what a reload would do without applying it")
+	return func(cli *clientContext, args []string) int {
+		if len(args) > 0 {
+			return cli.errorf(exitUsage, "Unexpected arguments: %s\n", strings.Join(args, " "))
+		}
+		query := url.Values{}
+		if *force {
+			query.Set("force", "true")
+		}
+		if *async {
+			query.Set("async", "true")
+		}
+		if *dryRun {
+			query.Set("dry_run", "true")
+		}
+
+		resp, code := cli.do("POST", "/reload?"+query.Encode(), nil, http.StatusOK, http.StatusAccepted, http.StatusInternalServerError)
+		if resp == nil {
+			return code
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusAccepted {
+			var job ReloadJob
+			if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+				return cli.errorf(exitUnavailable, "Couldn't decode reply: %v\n", err)
+			}
+			cli.output(job, func(w io.Writer) {
+				fmt.Fprintf(w, "Reload job %s %s\n", job.ID, job.State)
+			})
+			return exitOK
+		}
+
+		var result ReloadResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return cli.errorf(exitUnavailable, "Couldn't decode reply: %v\n", err)
+		}
+		cli.output(result, func(w io.Writer) { printReloadResult(w, result) })
+		if len(result.Error) > 0 {
+			return exitFailed
+		}
+		return exitOK
+	}
+}
+
+func printReloadResult(w io.Writer, result ReloadResult) {
+	switch {
+	case len(result.Error) > 0:
+		fmt.Fprintf(w, "Reload failed: %s\n", result.Error)
+	case result.DryRun:
+		fmt.Fprintf(w, "Dry run succeeded\n")
+	case result.Unchanged:
+		fmt.Fprintf(w, "Configuration unchanged, haproxy not reloaded\n")
+	default:
+		fmt.Fprintf(w, "Reloaded\n")
+	}
+	if len(result.ConfigHash) > 0 {
+		fmt.Fprintf(w, "Configuration hash: %s\n", result.ConfigHash)
+	}
+	if result.Diff != nil {
+		fmt.Fprintf(w, "Changes: %s\n", result.Diff)
+	}
+	if result.Validation != nil {
+		printValidationItems(w, result.Validation.Items)
+	}
+	for _, s := range result.Sockets {
+		fmt.Fprintf(w, "Socket %s in %s: %s", s.Address, s.Section, s.Status)
+		if len(s.Error) > 0 {
+			fmt.Fprintf(w, " (%s)", s.Error)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if plan := result.Plan; plan != nil {
+		fmt.Fprintf(w, "Action: %s", plan.Action)
+		if len(plan.Command) > 0 {
+			fmt.Fprintf(w, ", command: %s", strings.Join(plan.Command, " "))
+		}
+		if len(plan.Signal) > 0 {
+			fmt.Fprintf(w, ", signal: %s", plan.Signal)
+		}
+		if len(plan.Pids) > 0 {
+			fmt.Fprintf(w, ", pids: %v", plan.Pids)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func printValidationItems(w io.Writer, items []ValidationItem) {
+	for _, item := range items {
+		location := ""
+		if len(item.File) > 0 {
+			location = fmt.Sprintf("%s:%d: ", item.File, item.Line)
+		}
+		rule := ""
+		if len(item.Rule) > 0 {
+			rule = fmt.Sprintf(" [%s]", item.Rule)
+		}
+		fmt.Fprintf(w, "%s%s%s: %s\n", location, item.Severity, rule, item.Message)
+	}
+}
+
+func validateCommand(fs *flag.FlagSet) func(*clientContext, []string) int {
+	return func(cli *clientContext, args []string) int {
+		method, path, body := "GET", "/validate", io.Reader(nil)
+		switch len(args) {
+		case 0:
+		case 1:
+			var config []byte
+			var err error
+			if args[0] == "-" {
+				config, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				config, err = ioutil.ReadFile(args[0])
+			}
+			if err != nil {
+				return cli.errorf(exitUsage, "Couldn't read configuration: %v\n", err)
+			}
+			method, body = "POST", bytes.NewReader(config)
+		default:
+			return cli.errorf(exitUsage, "Only one configuration file can be validated\n")
+		}
+
+		resp, code := cli.do(method, path, body, http.StatusOK, http.StatusInternalServerError)
+		if resp == nil {
+			return code
+		}
+		defer resp.Body.Close()
+
+		var result ValidationResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return cli.errorf(exitUnavailable, "Couldn't decode reply: %v\n", err)
+		}
+		cli.output(result, func(w io.Writer) {
+			printValidationItems(w, result.Items)
+			if result.Valid {
+				fmt.Fprintf(w, "Configuration is valid\n")
+			} else {
+				fmt.Fprintf(w, "Configuration is not valid\n")
+			}
+		})
+		if !result.Valid {
+			return exitFailed
+		}
+		return exitOK
+	}
+}
+
+func statusCommand(fs *flag.FlagSet) func(*clientContext, []string) int {
+	return func(cli *clientContext, args []string) int {
+		resp, code := cli.do("GET", "/status", nil, http.StatusOK)
+		if resp == nil {
+			return code
+		}
+		defer resp.Body.Close()
+
+		var status map[string]json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return cli.errorf(exitUnavailable, "Couldn't decode reply: %v\n", err)
+		}
+		cli.output(status, func(w io.Writer) {
+			var names []string
+			for name := range status {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				var section bytes.Buffer
+				json.Indent(&section, status[name], "  ", "  ")
+				fmt.Fprintf(w, "%s:\n  %s\n", name, section.String())
+			}
+		})
+		return exitOK
+	}
+}
+
+func logsCommand(fs *flag.FlagSet) func(*clientContext, []string) int {
+	follow := fs.Bool("follow", false, "Keep printing new log lines")
+	lines := fs.Int("n", -1, "Number of last lines to print (default 100, or 10 when following)")
+	source := fs.String("source", "", "Only print lines from this source (syslog or haproxy)")
+	severity := fs.String("severity", "", "Minimum severity of the lines to print")
+	contains := fs.String("contains", "", "Only print lines containing this text")
+	return func(cli *clientContext, args []string) int {
+		if len(args) > 0 {
+			return cli.errorf(exitUsage, "Unexpected arguments: %s\n", strings.Join(args, " "))
+		}
+		query := url.Values{}
+		if *lines >= 0 {
+			query.Set("n", fmt.Sprintf("%d", *lines))
+		}
+		for name, value := range map[string]string{"source": *source, "severity": *severity, "contains": *contains} {
+			if len(value) > 0 {
+				query.Set(name, value)
+			}
+		}
+		path := "/logs"
+		if *follow {
+			path = "/logs/follow"
+		}
+
+		resp, code := cli.do("GET", path+"?"+query.Encode(), nil, http.StatusOK)
+		if resp == nil {
+			return code
+		}
+		defer resp.Body.Close()
+
+		if !*follow {
+			var entries []LogEntry
+			if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+				return cli.errorf(exitUnavailable, "Couldn't decode reply: %v\n", err)
+			}
+			for _, e := range entries {
+				cli.printLogEntry(e)
+			}
+			return exitOK
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var e LogEntry
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				return cli.errorf(exitUnavailable, "Couldn't decode log entry: %v\n", err)
+			}
+			cli.printLogEntry(e)
+		}
+		if err := scanner.Err(); err != nil {
+			return cli.errorf(exitUnavailable, "Connection with the wrapper lost: %v\n", err)
+		}
+		return exitOK
+	}
+}
+
+// printLogEntry prints log entries one per line, also with JSON output so it
+// can be followed.
+func (cli *clientContext) printLogEntry(e LogEntry) {
+	if cli.json {
+		json.NewEncoder(cli.stdout).Encode(e)
+		return
+	}
+	severity := fmt.Sprintf("%d", e.Severity)
+	if e.Severity >= 0 && e.Severity < len(syslogSeverities) {
+		severity = syslogSeverities[e.Severity]
+	}
+	source := e.Source
+	if len(e.Tag) > 0 {
+		source += "/" + e.Tag
+	}
+	fmt.Fprintf(cli.stdout, "%s %s %s: %s\n", e.Time.Format(time.RFC3339), source, severity, e.Message)
+}
+
+func runtimeCommand(fs *flag.FlagSet) func(*clientContext, []string) int {
+	return func(cli *clientContext, args []string) int {
+		if len(args) == 0 {
+			return cli.errorf(exitUsage, "Command expected\n")
+		}
+		command := strings.Join(args, " ")
+		resp, code := cli.do("POST", "/runtime", strings.NewReader(command), http.StatusOK)
+		if resp == nil {
+			return code
+		}
+		defer resp.Body.Close()
+
+		output, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return cli.errorf(exitUnavailable, "Couldn't read reply: %v\n", err)
+		}
+		result := map[string]string{"command": command, "output": string(output)}
+		cli.output(result, func(w io.Writer) { w.Write(output) })
+		return exitOK
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testControlServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("force") == "true" {
+			writeJSON(w, http.StatusInternalServerError, ReloadResult{Error: "haproxy failed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ReloadResult{Reloaded: true, ConfigHash: "abc", Diff: &ConfigDiff{Added: []string{"backend b"}}})
+	})
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			writeJSON(w, http.StatusInternalServerError, ValidationResult{Items: []ValidationItem{
+				{Severity: ValidationAlert, File: "haproxy.cfg", Line: 3, Message: "unknown keyword"},
+			}})
+			return
+		}
+		writeJSON(w, http.StatusOK, ValidationResult{Valid: true, Items: []ValidationItem{}})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer s3cr3t" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"reload": map[string]bool{"reloading": false}})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestClientCommands(t *testing.T) {
+	server := testControlServer()
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(configPath, []byte("global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Token files of the controller can be used too
+	identityTokenPath := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(identityTokenPath, []byte("\nops s3cr3t\nci other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		args   []string
+		code   int
+		output string
+	}{
+		{[]string{"reload"}, exitOK, "Changes: added backend b"},
+		{[]string{"reload", "-force"}, exitFailed, "Reload failed: haproxy failed"},
+		{[]string{"reload", "-json"}, exitOK, `"config_hash": "abc"`},
+		{[]string{"reload", "unexpected"}, exitUsage, ""},
+		{[]string{"validate"}, exitOK, "Configuration is valid"},
+		{[]string{"validate", configPath}, exitFailed, "haproxy.cfg:3: alert: unknown keyword"},
+		{[]string{"status"}, exitUnavailable, ""},
+		{[]string{"status", "-token-file", tokenPath}, exitOK, `"reloading": false`},
+		{[]string{"status", "-token-file", identityTokenPath}, exitOK, `"reloading": false`},
+		{[]string{"runtime", "show", "info"}, exitUnavailable, ""},
+	}
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{c.args[0], "-address", address}, c.args[1:]...)
+		code := runClient(args[0], args[1:], &stdout, &stderr)
+		if code != c.code {
+			t.Errorf("%v: exit code %d expected, found %d (%s)", c.args, c.code, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), c.output) {
+			t.Errorf("%v: output expected to contain %q, found %q", c.args, c.output, stdout.String())
+		}
+	}
+
+	var stderr bytes.Buffer
+	if code := runClient("status", []string{"-address", "127.0.0.1:1"}, ioutil.Discard, &stderr); code != exitUnavailable {
+		t.Errorf("unavailable controller: exit code %d expected, found %d", exitUnavailable, code)
+	}
+}
+
+// testStatsSocket answers to every command with its content
+func testStatsSocket(t *testing.T, path string) net.Listener {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "executed %s\n", strings.TrimSpace(command))
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestRuntimeAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	statsSocket := filepath.Join(dir, "stats.sock")
+	l := testStatsSocket(t, statsSocket)
+	defer l.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/runtime", NewRuntimeAPI(statsSocket, runtimeAPITimeout))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	var stdout, stderr bytes.Buffer
+	code := runClient("runtime", []string{"-address", address, "show", "servers", "state"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code %d, %s", code, stderr.String())
+	}
+	if stdout.String() != "executed show servers state\n" {
+		t.Fatalf("unexpected output: %q", stdout.String())
+	}
+
+	stdout.Reset()
+	code = runClient("runtime", []string{"-address", address, "-json", "show info"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code %d, %s", code, stderr.String())
+	}
+	var result map[string]string
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["output"] != "executed show info\n" {
+		t.Fatalf("unexpected output: %v", result)
+	}
+
+	resp, err := http.Get(server.URL + "/runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET requests shouldn't be accepted, found %s", resp.Status)
+	}
+
+	l.Close()
+	code = runClient("runtime", []string{"-address", address, "show info"}, ioutil.Discard, ioutil.Discard)
+	if code != exitFailed {
+		t.Fatalf("exit code %d expected with unavailable stats socket, found %d", exitFailed, code)
+	}
+}
@@ -15,65 +15,344 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// A StatusReporter provides information to be shown in the status entry
+// point of the controller.
+type StatusReporter interface {
+	Status() interface{}
+}
+
+// Maximum size of configurations uploaded to the controller
+const maxConfigSize = 16 << 20
+
+// Default file mode of unix sockets for the controller
+const defaultControlSocketMode = 0660
+
+// A ControlListener is an address where the controller listens, unix sockets
+// are created with the given file mode and group.
+type ControlListener struct {
+	Network string
+	Address string
+	Mode    os.FileMode
+	Group   string
+}
+
+// ParseControlListener parses listeners in the form addr:port, tcp://addr:port
+// or unix:///path, unix sockets can be followed by ?mode=<mode>&group=<group>.
+func ParseControlListener(s string) (ControlListener, error) {
+	if !strings.Contains(s, "://") {
+		s = "tcp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ControlListener{}, err
+	}
+	l := ControlListener{Network: u.Scheme}
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return l, fmt.Errorf("incorrect address in %s: %v", s, err)
+		}
+		l.Address = u.Host
+	case "unix":
+		if len(u.Path) == 0 {
+			return l, fmt.Errorf("path expected in %s", s)
+		}
+		l.Address = u.Path
+		l.Mode = defaultControlSocketMode
+		if mode := u.Query().Get("mode"); len(mode) > 0 {
+			m, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil {
+				return l, fmt.Errorf("incorrect mode in %s: %v", s, err)
+			}
+			l.Mode = os.FileMode(m)
+		}
+		l.Group = u.Query().Get("group")
+	default:
+		return l, fmt.Errorf("unknown control listener type in %s", s)
+	}
+	return l, nil
+}
+
+func (l ControlListener) String() string {
+	return fmt.Sprintf("%s://%s", l.Network, l.Address)
+}
+
+// listen starts listening, unix sockets are created in a private directory
+// and moved to their address once their permissions are set, so they are
+// never reachable with the default permissions.
+func (l ControlListener) listen() (net.Listener, error) {
+	if l.Network != "unix" {
+		return net.Listen(l.Network, l.Address)
+	}
+
+	if info, err := os.Lstat(l.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", l.Address)
+		}
+		os.Remove(l.Address)
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(l.Address), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, filepath.Base(l.Address))
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Socket is removed from its final address on close
+	listener.SetUnlinkOnClose(false)
+	if err := l.setPermissions(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(path, l.Address); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixControlListener{UnixListener: listener, path: l.Address}, nil
+}
+
+func (l ControlListener) setPermissions(path string) error {
+	if err := os.Chmod(path, l.Mode); err != nil {
+		return err
+	}
+	if len(l.Group) == 0 {
+		return nil
+	}
+	gid, err := strconv.Atoi(l.Group)
+	if err != nil {
+		group, err := user.LookupGroup(l.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(group.Gid)
+	}
+	return os.Chown(path, -1, gid)
+}
+
+// unixControlListener removes the socket file when closed
+type unixControlListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixControlListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
 type Controller struct {
-	address   string
-	haproxy   HaproxyServer
+	listeners []ControlListener
+	reloader  *Reloader
+	jobs      *ReloadJobs
 	validator HaproxyConfigValidator
 
-	done     bool
-	listener net.Listener
+	handler   *http.ServeMux
+	statuses  map[string]StatusReporter
+	tokens    *TokenFile
+	tlsConfig *tls.Config
+
+	done         bool
+	netListeners []net.Listener
 }
 
-func NewController(address string, haproxy HaproxyServer, validator HaproxyConfigValidator) *Controller {
+// NewController returns a controller that listens on all the given listeners,
+// reloads are requested through jobs
+func NewController(listeners []ControlListener, jobs *ReloadJobs, validator HaproxyConfigValidator) *Controller {
 	return &Controller{
-		address:   address,
-		haproxy:   haproxy,
+		listeners: listeners,
+		reloader:  jobs.reloader,
+		jobs:      jobs,
 		validator: validator,
+		handler:   http.NewServeMux(),
+		statuses:  make(map[string]StatusReporter),
 	}
 }
 
+// AddStatus registers a reporter whose status is shown under the given name
+// in the status entry point, it has to be called before Run.
+func (c *Controller) AddStatus(name string, reporter StatusReporter) {
+	c.statuses[name] = reporter
+}
+
+// RequireToken makes the controller reject requests without a bearer token
+// found in the token file, it has to be called before Run.
+func (c *Controller) RequireToken(tokens *TokenFile) {
+	c.tokens = tokens
+}
+
+// UseTLS makes the controller use TLS in TCP listeners, it has to be called
+// before Run.
+func (c *Controller) UseTLS(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+// HandleFunc registers additional entry points in the controller, it has to
+// be called before Run.
+func (c *Controller) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	c.handler.HandleFunc(pattern, handler)
+}
+
 func (c *Controller) Run() error {
-	listener, err := net.Listen("tcp", c.address)
-	if err != nil {
-		return err
+	for _, l := range c.listeners {
+		listener, err := l.listen()
+		if err != nil {
+			c.closeListeners()
+			return fmt.Errorf("couldn't listen on %s: %v", l, err)
+		}
+		if c.tlsConfig != nil && l.Network == "tcp" {
+			listener = tls.NewListener(listener, c.tlsConfig)
+		}
+		c.netListeners = append(c.netListeners, listener)
+		log.Printf("Controller listening on '%s'\n", l)
 	}
-	c.listener = listener
-	log.Printf("Controller listening on '%s'\n", c.address)
 
-	handler := http.NewServeMux()
-	handler.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
-		if err := c.haproxy.Reload(); err != nil {
-			msg := fmt.Sprintf("Couldn't reload: %v\n", err)
-			log.Println(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
+	handler := c.handler
+	handler.HandleFunc("/reload", c.reload)
+	handler.HandleFunc("/reload/", func(w http.ResponseWriter, req *http.Request) {
+		job, found := c.jobs.Get(strings.TrimPrefix(req.URL.Path, "/reload/"))
+		if !found {
+			http.NotFound(w, req)
 			return
 		}
-		fmt.Fprintf(w, "OK\n")
+		writeJSON(w, http.StatusOK, job)
 	})
 	handler.HandleFunc("/validate", func(w http.ResponseWriter, req *http.Request) {
-		if err := c.validator.Validate(); err != nil {
-			msg := fmt.Sprintf("Invalid configuration: %v\n", err)
-			log.Println(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
+		if req.Method == "POST" {
+			c.validateContent(w, req)
 			return
 		}
+		result, err := c.validator.Validate()
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("Invalid configuration: %v\n", err)
+			status = http.StatusInternalServerError
+		}
+		writeJSON(w, status, result)
+	})
+
+	handler.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "OK\n")
 	})
 
-	err = http.Serve(c.listener, handler)
+	handler.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		status := make(map[string]interface{})
+		for name, reporter := range c.statuses {
+			status[name] = reporter.Status()
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	errs := make(chan error, len(c.netListeners))
+	for _, listener := range c.netListeners {
+		go func(listener net.Listener) {
+			errs <- http.Serve(listener, audit(handler, c.tokens, c.tlsConfig != nil && c.tlsConfig.ClientCAs != nil))
+		}(listener)
+	}
+	err := <-errs
 	if err != nil && !c.done {
+		c.closeListeners()
 		return fmt.Errorf("Controller error: %v", err)
 	}
 	return nil
 }
 
+// reload reloads haproxy, reloads requested while another one is running are
+// coalesced. With async=true it replies immediately with the job of the reload,
+// that can be queried later in /reload/<id>.
+func (c *Controller) reload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && (req.FormValue("dry_run") == "true" || req.FormValue("async") == "true") {
+		http.Error(w, "Dry runs and asynchronous reloads are requested with POST requests\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.FormValue("dry_run") == "true" {
+		result, err := c.reloader.DryRun()
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("Dry run failed: %v\n", err)
+			status = http.StatusInternalServerError
+		}
+		writeJSON(w, status, result)
+		return
+	}
+
+	id := c.jobs.Submit(req.FormValue("force") == "true")
+	if req.FormValue("async") == "true" {
+		job, _ := c.jobs.Get(id)
+		w.Header().Set("Location", "/reload/"+id)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	job, _ := c.jobs.Wait(id)
+	status := http.StatusOK
+	if job.State == JobFailed {
+		log.Printf("Couldn't reload: %s\n", job.Result.Error)
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, job.Result)
+}
+
+// validateContent validates the configuration in the body of the request,
+// without modifying the running configuration.
+func (c *Controller) validateContent(w http.ResponseWriter, req *http.Request) {
+	validator, ok := c.validator.(HaproxyContentValidator)
+	if !ok {
+		http.Error(w, "Validation of uploaded configurations not supported\n", http.StatusNotImplemented)
+		return
+	}
+	config, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxConfigSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read configuration: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	result, err := validator.ValidateContent(config)
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("Invalid uploaded configuration: %v\n", err)
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Couldn't encode response: %v\n", err)
+	}
+}
+
 func (c *Controller) Stop() error {
 	c.done = true
-	return c.listener.Close()
+	return c.closeListeners()
+}
+
+func (c *Controller) closeListeners() error {
+	var err error
+	for _, listener := range c.netListeners {
+		if cerr := listener.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
 }
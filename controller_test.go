@@ -0,0 +1,139 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseControlListener(t *testing.T) {
+	cases := []struct {
+		arg      string
+		expected ControlListener
+	}{
+		{"127.0.0.1:15000", ControlListener{"tcp", "127.0.0.1:15000", 0, ""}},
+		{"tcp://[::1]:15000", ControlListener{"tcp", "[::1]:15000", 0, ""}},
+		{"unix:///run/haproxy/control.sock", ControlListener{"unix", "/run/haproxy/control.sock", 0660, ""}},
+		{"unix:///run/haproxy/control.sock?mode=0600&group=haproxy", ControlListener{"unix", "/run/haproxy/control.sock", 0600, "haproxy"}},
+	}
+	for _, c := range cases {
+		l, err := ParseControlListener(c.arg)
+		if err != nil {
+			t.Fatalf("%s: %v", c.arg, err)
+		}
+		if l != c.expected {
+			t.Errorf("%s: expected %+v, found %+v", c.arg, c.expected, l)
+		}
+	}
+
+	for _, arg := range []string{"127.0.0.1", "unix://", "unix:///run/control.sock?mode=abc", "udp://127.0.0.1:15000"} {
+		if _, err := ParseControlListener(arg); err == nil {
+			t.Errorf("%s: error expected", arg)
+		}
+	}
+}
+
+// unixClient returns an HTTP client that connects to the given unix socket
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+}
+
+func TestControllerListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "control.sock")
+	listeners := []ControlListener{
+		{Network: "tcp", Address: "127.0.0.1:0"},
+		{Network: "unix", Address: socket, Mode: 0600},
+	}
+	controller := NewController(listeners, NewReloadJobs(nil, reloadJobsHistory), &fakeValidator{})
+	done := make(chan error)
+	go func() { done <- controller.Run() }()
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("controller not listening on socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket with mode 0600 expected, found: %v (%v)", info.Mode(), err)
+	}
+
+	resp, err := unixClient(socket).Get("http://control/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	// Dry runs cannot be requested with GET
+	resp, err = unixClient(socket).Get("http://control/reload?dry_run=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	controller.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// Socket and its temporary directory are removed
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("no file expected after stopping, found %d", len(entries))
+	}
+}
+
+func TestControlListenerNotSocket(t *testing.T) {
+	f, err := ioutil.TempFile("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	l := ControlListener{Network: "unix", Address: f.Name(), Mode: 0600}
+	if listener, err := l.listen(); err == nil {
+		listener.Close()
+		t.Fatal("listening on a path that is not a socket should fail")
+	}
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Fatalf("existing file shouldn't be removed: %v", err)
+	}
+}
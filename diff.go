@@ -0,0 +1,173 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SectionChange describes the changes in a section present in both
+// configurations
+type SectionChange struct {
+	Section         string   `json:"section"`
+	AddedServers    []string `json:"added_servers,omitempty"`
+	RemovedServers  []string `json:"removed_servers,omitempty"`
+	ModifiedServers []string `json:"modified_servers,omitempty"`
+	AddedLines      []string `json:"added_lines,omitempty"`
+	RemovedLines    []string `json:"removed_lines,omitempty"`
+}
+
+// ConfigDiff describes the changes between two configurations, by section
+type ConfigDiff struct {
+	Added    []string        `json:"added,omitempty"`
+	Removed  []string        `json:"removed,omitempty"`
+	Modified []SectionChange `json:"modified,omitempty"`
+}
+
+// Empty returns true if there are no changes
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+func (d *ConfigDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var parts []string
+	if len(d.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(d.Added, ", "))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(d.Removed, ", "))
+	}
+	for _, m := range d.Modified {
+		var changes []string
+		if len(m.AddedServers) > 0 {
+			changes = append(changes, "added servers "+strings.Join(m.AddedServers, ", "))
+		}
+		if len(m.RemovedServers) > 0 {
+			changes = append(changes, "removed servers "+strings.Join(m.RemovedServers, ", "))
+		}
+		if len(m.ModifiedServers) > 0 {
+			changes = append(changes, "modified servers "+strings.Join(m.ModifiedServers, ", "))
+		}
+		if len(m.AddedLines)+len(m.RemovedLines) > 0 {
+			changes = append(changes, fmt.Sprintf("%d lines added, %d removed", len(m.AddedLines), len(m.RemovedLines)))
+		}
+		parts = append(parts, fmt.Sprintf("modified %s (%s)", m.Section, strings.Join(changes, "; ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// sectionKeys identifies the sections in a configuration, repeated sections,
+// as multiple defaults, are numbered in order of appearance
+func sectionKeys(c *HaproxyConfig) (map[string]*ConfigSection, []string) {
+	sections := make(map[string]*ConfigSection)
+	var keys []string
+	if c == nil {
+		return sections, keys
+	}
+	for _, s := range c.Sections {
+		key := strings.TrimSpace(s.Type + " " + s.Name)
+		base := key
+		for i := 2; sections[key] != nil; i++ {
+			key = fmt.Sprintf("%s #%d", base, i)
+		}
+		sections[key] = s
+		keys = append(keys, key)
+	}
+	return sections, keys
+}
+
+// sectionContent splits the lines of a section in servers by name and
+// the rest of lines
+func sectionContent(s *ConfigSection) (map[string]string, map[string]int) {
+	servers := make(map[string]string)
+	lines := make(map[string]int)
+	for _, line := range s.Lines {
+		if line.Keyword() == "server" && len(line.Fields) > 1 {
+			servers[line.Fields[1]] = line.String()
+			continue
+		}
+		lines[line.String()]++
+	}
+	return servers, lines
+}
+
+func diffSection(key string, old, new *ConfigSection) *SectionChange {
+	oldServers, oldLines := sectionContent(old)
+	newServers, newLines := sectionContent(new)
+
+	change := SectionChange{Section: key}
+	for name, line := range newServers {
+		if oldLine, found := oldServers[name]; !found {
+			change.AddedServers = append(change.AddedServers, name)
+		} else if oldLine != line {
+			change.ModifiedServers = append(change.ModifiedServers, name)
+		}
+	}
+	for name := range oldServers {
+		if _, found := newServers[name]; !found {
+			change.RemovedServers = append(change.RemovedServers, name)
+		}
+	}
+	for line, n := range newLines {
+		for i := oldLines[line]; i < n; i++ {
+			change.AddedLines = append(change.AddedLines, line)
+		}
+	}
+	for line, n := range oldLines {
+		for i := newLines[line]; i < n; i++ {
+			change.RemovedLines = append(change.RemovedLines, line)
+		}
+	}
+
+	if len(change.AddedServers)+len(change.RemovedServers)+len(change.ModifiedServers)+
+		len(change.AddedLines)+len(change.RemovedLines) == 0 {
+		return nil
+	}
+	sort.Strings(change.AddedServers)
+	sort.Strings(change.RemovedServers)
+	sort.Strings(change.ModifiedServers)
+	sort.Strings(change.AddedLines)
+	sort.Strings(change.RemovedLines)
+	return &change
+}
+
+// DiffHaproxyConfig compares two configurations, old can be nil
+func DiffHaproxyConfig(old, new *HaproxyConfig) *ConfigDiff {
+	oldSections, oldKeys := sectionKeys(old)
+	newSections, newKeys := sectionKeys(new)
+
+	diff := &ConfigDiff{}
+	for _, key := range newKeys {
+		oldSection, found := oldSections[key]
+		if !found {
+			diff.Added = append(diff.Added, key)
+			continue
+		}
+		if change := diffSection(key, oldSection, newSections[key]); change != nil {
+			diff.Modified = append(diff.Modified, *change)
+		}
+	}
+	for _, key := range oldKeys {
+		if _, found := newSections[key]; !found {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,90 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const diffOldConfig = `
+defaults
+  timeout connect 5s
+
+frontend http
+  bind :80
+  default_backend app
+
+backend app
+  server app1 10.0.0.1:8080 check
+  server app2 10.0.0.2:8080 check
+
+backend old
+  server old1 10.0.1.1:8080
+`
+
+const diffNewConfig = `
+defaults
+  timeout connect 5s
+
+frontend http
+  bind :80
+  bind :8080
+  default_backend app
+
+backend app
+  server app1 10.0.0.1:8080 check
+  server app2 10.0.0.2:9090 check
+  server app3 10.0.0.3:8080 check
+
+backend new
+  server new1 10.0.2.1:8080
+`
+
+func parseTestConfig(t *testing.T, config string) *HaproxyConfig {
+	c, err := ParseHaproxyConfig(strings.NewReader(config), "haproxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDiffHaproxyConfig(t *testing.T) {
+	old := parseTestConfig(t, diffOldConfig)
+	new := parseTestConfig(t, diffNewConfig)
+
+	expected := &ConfigDiff{
+		Added:   []string{"backend new"},
+		Removed: []string{"backend old"},
+		Modified: []SectionChange{
+			{Section: "frontend http", AddedLines: []string{"bind :8080"}},
+			{Section: "backend app", AddedServers: []string{"app3"}, ModifiedServers: []string{"app2"}},
+		},
+	}
+	diff := DiffHaproxyConfig(old, new)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("expected:\n%+v\nfound:\n%+v", expected, diff)
+	}
+
+	if diff := DiffHaproxyConfig(old, old); !diff.Empty() {
+		t.Fatalf("no changes expected, found: %s", diff)
+	}
+
+	diff = DiffHaproxyConfig(nil, old)
+	if len(diff.Added) != 4 || len(diff.Removed) != 0 || len(diff.Modified) != 0 {
+		t.Fatalf("all sections should be added, found: %s", diff)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events
+const (
+	EventHaproxyStarted     = "haproxy_started"
+	EventHaproxyStopped     = "haproxy_stopped"
+	EventHaproxyCrashed     = "haproxy_crashed"
+	EventReloadRequested    = "reload_requested"
+	EventReloadCoalesced    = "reload_coalesced"
+	EventReloadSucceeded    = "reload_succeeded"
+	EventReloadUnchanged    = "reload_unchanged"
+	EventReloadFailed       = "reload_failed"
+	EventValidationFailed   = "validation_failed"
+	EventNetQueueCapture    = "netqueue_capture"
+	EventNetQueueRelease    = "netqueue_release"
+	EventOldProcessFinished = "old_process_finished"
+)
+
+// Subscribers not reading fast enough lose events instead of blocking
+// publishers.
+const eventSubscriberBufferSize = 256
+
+// Event is something that happened in the lifecycle of haproxy
+type Event struct {
+	Time time.Time              `json:"time"`
+	Type string                 `json:"type"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventBus distributes events to its subscribers and handlers
+type EventBus struct {
+	sync.Mutex
+
+	subscribers map[chan Event]struct{}
+	handlers    map[int]func(Event)
+	nextHandler int
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+		handlers:    make(map[int]func(Event)),
+	}
+}
+
+// Publish sends an event to all subscribers, it never blocks, and calls the
+// handlers.
+func (b *EventBus) Publish(eventType string, data map[string]interface{}) {
+	if b == nil {
+		return
+	}
+	e := Event{Time: time.Now(), Type: eventType, Data: data}
+
+	b.Lock()
+	for s := range b.subscribers {
+		select {
+		case s <- e:
+		default:
+		}
+	}
+	handlers := make([]func(Event), 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// Handle registers a function that is called with every event published, and
+// returns a function to unregister it. Handlers are called by publishers, so
+// they never lose events, but they must not block.
+func (b *EventBus) Handle(handler func(Event)) func() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.nextHandler++
+	id := b.nextHandler
+	b.handlers[id] = handler
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// Subscribe returns a channel where new events are sent, and a function to
+// cancel the subscription.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	b.Lock()
+	defer b.Unlock()
+
+	s := make(chan Event, eventSubscriberBufferSize)
+	b.subscribers[s] = struct{}{}
+	return s, func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subscribers, s)
+	}
+}
+
+// ServeHTTP streams events as server-sent events, the types of events can be
+// selected with a comma-separated list in the types parameter.
+func (b *EventBus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	types := make(map[string]bool)
+	if t := req.FormValue("types"); len(t) > 0 {
+		for _, eventType := range strings.Split(t, ",") {
+			types[eventType] = true
+		}
+	}
+
+	events, cancel := b.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-events:
+			if len(types) > 0 && !types[e.Type] {
+				continue
+			}
+			d, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, d); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// eventValidator publishes an event when validation fails
+type eventValidator struct {
+	HaproxyConfigValidator
+	events *EventBus
+}
+
+func NewEventValidator(validator HaproxyConfigValidator, events *EventBus) HaproxyConfigValidator {
+	return &eventValidator{HaproxyConfigValidator: validator, events: events}
+}
+
+func (v *eventValidator) Validate() (ValidationResult, error) {
+	result, err := v.HaproxyConfigValidator.Validate()
+	v.publish(result, err, false)
+	return result, err
+}
+
+// ValidateContent validates configurations that would replace the current
+// one, if supported by the underlying validator.
+func (v *eventValidator) ValidateContent(config []byte) (ValidationResult, error) {
+	validator, ok := v.HaproxyConfigValidator.(HaproxyContentValidator)
+	if !ok {
+		return ValidationResult{}, fmt.Errorf("validator doesn't support validating content")
+	}
+	result, err := validator.ValidateContent(config)
+	v.publish(result, err, true)
+	return result, err
+}
+
+func (v *eventValidator) publish(result ValidationResult, err error, content bool) {
+	if err == nil {
+		return
+	}
+	v.events.Publish(EventValidationFailed, map[string]interface{}{
+		"error":   err.Error(),
+		"items":   result.Items,
+		"content": content,
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBusSlowSubscribers(t *testing.T) {
+	events := NewEventBus()
+	slow, cancel := events.Subscribe()
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*eventSubscriberBufferSize; i++ {
+			events.Publish(EventReloadRequested, nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing shouldn't block on slow subscribers")
+	}
+	if n := len(slow); n != eventSubscriberBufferSize {
+		t.Fatalf("%d buffered events expected, found %d", eventSubscriberBufferSize, n)
+	}
+
+	// Publishing in a nil bus is a no-op
+	var nilEvents *EventBus
+	nilEvents.Publish(EventReloadRequested, nil)
+}
+
+func TestEventBusHandle(t *testing.T) {
+	events := NewEventBus()
+	handled := 0
+	cancel := events.Handle(func(e Event) { handled++ })
+	for i := 0; i < 2*eventSubscriberBufferSize; i++ {
+		events.Publish(EventReloadRequested, nil)
+	}
+	if handled != 2*eventSubscriberBufferSize {
+		t.Fatalf("%d handled events expected, found %d", 2*eventSubscriberBufferSize, handled)
+	}
+
+	cancel()
+	events.Publish(EventReloadRequested, nil)
+	if handled != 2*eventSubscriberBufferSize {
+		t.Fatal("no event expected after cancelling the handler")
+	}
+}
+
+func TestEventBusServeHTTP(t *testing.T) {
+	events := NewEventBus()
+	server := httptest.NewServer(events)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?types=" + EventReloadSucceeded + "," + EventValidationFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events.Publish(EventReloadRequested, map[string]interface{}{"job": "1"})
+	validator := NewEventValidator(&fakeValidator{err: fmt.Errorf("invalid")}, events)
+	validator.Validate()
+	reloader := NewReloader(&fakeHaproxy{}, nil, validator, nil, events)
+	reloader.Reload(true)
+
+	expected := []string{EventValidationFailed, EventReloadSucceeded}
+	reader := bufio.NewReader(resp.Body)
+	for _, eventType := range expected {
+		var line string
+		for !strings.HasPrefix(line, "data: ") {
+			if line, err = reader.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != eventType {
+			t.Fatalf("expected %s event, found: %+v", eventType, e)
+		}
+	}
+}
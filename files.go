@@ -0,0 +1,136 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// listFiles returns the files found in the given paths, files in
+// directories are included, but not recursively. Hidden files are ignored, as
+// the ones used by Kubernetes to atomically update volumes.
+func listFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			file := filepath.Join(path, entry.Name())
+			// Follow symlinks
+			if info, err := os.Stat(file); err != nil || info.IsDir() {
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// configHash returns a hash of the content of the files in the given paths.
+func configHash(paths []string) (string, error) {
+	files, err := listFiles(paths)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", file)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// effectiveConfigHash returns a hash of the configuration and of all the files
+// it references, so it changes if anything haproxy would load changes. If
+// replacement is not nil, it is used as the content of the first file.
+func effectiveConfigHash(configFiles []string, replacement []byte) (string, error) {
+	config, err := ParseHaproxyConfigFiles(configFiles, replacement)
+	if err != nil {
+		return "", err
+	}
+	paths := configFiles
+	if replacement != nil {
+		paths = configFiles[1:]
+	}
+	files, err := configHash(paths)
+	if err != nil {
+		return "", err
+	}
+	referenced, err := configHash(config.ReferencedFiles())
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(replacement)
+	fmt.Fprintf(h, "\x00%s\x00%s", files, referenced)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic replaces the content of a file, so readers never find it
+// half-written. The file keeps its mode if it exists, perm is used otherwise.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
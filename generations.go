@@ -0,0 +1,241 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	GenerationActive   = "active"
+	GenerationDraining = "draining"
+	GenerationFinished = "finished"
+)
+
+// Number of finished generations kept in the registry
+const generationsHistory = 20
+
+// HaproxyProcess is one of the processes of a generation, exit status is only
+// known for children of the wrapper, what happens when it runs as PID 1.
+type HaproxyProcess struct {
+	Pid        int       `json:"pid"`
+	Finished   time.Time `json:"finished"`
+	ExitStatus *int      `json:"exit_status,omitempty"`
+	Signal     string    `json:"signal,omitempty"`
+
+	// Start time of the process, so it is not mistaken for other processes
+	// reusing its pid
+	startTime uint64
+}
+
+// HaproxyGeneration is a set of haproxy processes started together, by a
+// start or a reload. When a new generation is started, the previous one is
+// draining until its processes finish their current connections.
+type HaproxyGeneration struct {
+	ID            int              `json:"id"`
+	State         string           `json:"state"`
+	ConfigHash    string           `json:"config_hash,omitempty"`
+	Started       time.Time        `json:"started"`
+	DrainingSince time.Time        `json:"draining_since"`
+	Finished      time.Time        `json:"finished"`
+	HardStopped   bool             `json:"hard_stopped,omitempty"`
+	Processes     []HaproxyProcess `json:"processes"`
+}
+
+func (g *HaproxyGeneration) finished() bool {
+	for _, p := range g.Processes {
+		if p.Finished.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// HaproxyGenerations keeps the registry of haproxy process generations.
+// Draining generations are hard-stopped after hardStopAfter if it is not
+// zero, and a warning is logged when more than maxAlive generations are
+// alive.
+type HaproxyGenerations struct {
+	sync.Mutex
+
+	hardStopAfter time.Duration
+	maxAlive      int
+	next          int
+	generations   []*HaproxyGeneration
+}
+
+func NewHaproxyGenerations(hardStopAfter time.Duration, maxAlive int) *HaproxyGenerations {
+	return &HaproxyGenerations{
+		hardStopAfter: hardStopAfter,
+		maxAlive:      maxAlive,
+	}
+}
+
+// Add registers a new active generation, the previous active one starts
+// draining. It is safe to call it on nil registries.
+func (g *HaproxyGenerations) Add(pids []int, configHash string) *HaproxyGeneration {
+	if g == nil {
+		return nil
+	}
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	alive := 0
+	for _, generation := range g.generations {
+		if generation.State == GenerationActive {
+			generation.State = GenerationDraining
+			generation.DrainingSince = now
+			if g.hardStopAfter > 0 {
+				id := generation.ID
+				time.AfterFunc(g.hardStopAfter, func() { g.hardStop(id) })
+			}
+		}
+		if generation.State != GenerationFinished {
+			alive++
+		}
+	}
+
+	g.next++
+	generation := &HaproxyGeneration{
+		ID:         g.next,
+		State:      GenerationActive,
+		ConfigHash: configHash,
+		Started:    now,
+	}
+	for _, pid := range pids {
+		startTime, _ := processStartTime(pid)
+		generation.Processes = append(generation.Processes, HaproxyProcess{Pid: pid, startTime: startTime})
+	}
+	g.generations = append(g.generations, generation)
+	alive++
+
+	if g.maxAlive > 0 && alive > g.maxAlive {
+		log.Printf("Warning: %d haproxy generations alive, old processes are not finishing before new reloads\n", alive)
+	}
+	return generation
+}
+
+// Finish records the end of a process, status is nil if it is unknown. It
+// returns the state of the generation of the process before it finished.
+func (g *HaproxyGenerations) Finish(pid int, status *syscall.WaitStatus) string {
+	if g == nil {
+		return ""
+	}
+	g.Lock()
+	defer g.Unlock()
+
+	for _, generation := range g.generations {
+		if generation.State == GenerationFinished {
+			continue
+		}
+		for i := range generation.Processes {
+			p := &generation.Processes[i]
+			if p.Pid != pid || !p.Finished.IsZero() {
+				continue
+			}
+			p.Finished = time.Now()
+			if status != nil {
+				exitStatus := status.ExitStatus()
+				p.ExitStatus = &exitStatus
+				if status.Signaled() {
+					p.Signal = status.Signal().String()
+				}
+			}
+			state := generation.State
+			if generation.finished() {
+				generation.State = GenerationFinished
+				generation.Finished = p.Finished
+				g.prune()
+			}
+			return state
+		}
+	}
+	return ""
+}
+
+// prune removes the oldest finished generations beyond the history
+func (g *HaproxyGenerations) prune() {
+	finished := 0
+	for _, generation := range g.generations {
+		if generation.State == GenerationFinished {
+			finished++
+		}
+	}
+	var generations []*HaproxyGeneration
+	for _, generation := range g.generations {
+		if generation.State == GenerationFinished && finished > generationsHistory {
+			finished--
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	g.generations = generations
+}
+
+// hardStop stops the processes of a generation still draining
+func (g *HaproxyGenerations) hardStop(id int) {
+	g.Lock()
+	defer g.Unlock()
+	for _, generation := range g.generations {
+		if generation.ID != id || generation.State != GenerationDraining {
+			continue
+		}
+		generation.HardStopped = true
+		for _, p := range generation.Processes {
+			if !p.Finished.IsZero() {
+				continue
+			}
+			if startTime, err := processStartTime(p.Pid); err != nil || startTime != p.startTime {
+				// Finished, and its pid is not used or used by other
+				// process
+				continue
+			}
+			log.Printf("Old haproxy process %d still running after %s, stopping it\n", p.Pid, g.hardStopAfter)
+			if err := syscall.Kill(p.Pid, syscall.SIGTERM); err != nil {
+				log.Printf("Couldn't stop old haproxy process %d: %v\n", p.Pid, err)
+			}
+		}
+	}
+}
+
+// Generations returns a copy of the generations in the registry
+func (g *HaproxyGenerations) Generations() []HaproxyGeneration {
+	g.Lock()
+	defer g.Unlock()
+	generations := make([]HaproxyGeneration, len(g.generations))
+	for i, generation := range g.generations {
+		generations[i] = *generation
+		generations[i].Processes = append([]HaproxyProcess(nil), generation.Processes...)
+	}
+	return generations
+}
+
+func (g *HaproxyGenerations) Status() interface{} {
+	generations := g.Generations()
+	alive := 0
+	for _, generation := range generations {
+		if generation.State != GenerationFinished {
+			alive++
+		}
+	}
+	return map[string]interface{}{
+		"alive":       alive,
+		"generations": generations,
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHaproxyGenerations(t *testing.T) {
+	generations := NewHaproxyGenerations(0, 2)
+
+	first := generations.Add([]int{100, 101}, "a")
+	second := generations.Add([]int{200}, "b")
+	if first.ID != 1 || second.ID != 2 {
+		t.Fatalf("unexpected generation IDs %d, %d", first.ID, second.ID)
+	}
+
+	list := generations.Generations()
+	if list[0].State != GenerationDraining || list[0].DrainingSince.IsZero() {
+		t.Fatalf("previous generation expected to be draining, found %+v", list[0])
+	}
+	if list[1].State != GenerationActive || list[1].ConfigHash != "b" {
+		t.Fatalf("new generation expected to be active, found %+v", list[1])
+	}
+
+	status := syscall.WaitStatus(3 << 8)
+	if state := generations.Finish(100, &status); state != GenerationDraining {
+		t.Fatalf("draining state expected, found %q", state)
+	}
+	list = generations.Generations()
+	if list[0].State != GenerationDraining {
+		t.Fatal("generation shouldn't finish till all its processes finish")
+	}
+	if exitStatus := list[0].Processes[0].ExitStatus; exitStatus == nil || *exitStatus != 3 {
+		t.Fatalf("exit status 3 expected, found %v", exitStatus)
+	}
+
+	generations.Finish(101, nil)
+	list = generations.Generations()
+	if list[0].State != GenerationFinished || list[0].Finished.IsZero() || list[0].Processes[1].ExitStatus != nil {
+		t.Fatalf("generation expected to be finished with unknown status, found %+v", list[0])
+	}
+	if state := generations.Finish(999, nil); state != "" {
+		t.Fatalf("no state expected for unknown processes, found %q", state)
+	}
+
+	alive := generations.Status().(map[string]interface{})["alive"]
+	if alive != 1 {
+		t.Fatalf("one generation expected to be alive, found %v", alive)
+	}
+
+	// Old finished generations are forgotten
+	for i := 0; i < 2*generationsHistory; i++ {
+		generations.Add([]int{1000 + i}, "c")
+		generations.Finish(1000+i, nil)
+	}
+	if n := len(generations.Generations()); n > generationsHistory+1 {
+		t.Fatalf("at most %d generations expected, found %d", generationsHistory+1, n)
+	}
+
+	var nilGenerations *HaproxyGenerations
+	nilGenerations.Add([]int{1}, "")
+	nilGenerations.Finish(1, nil)
+}
+
+func TestHaproxyGenerationsHardStop(t *testing.T) {
+	generations := NewHaproxyGenerations(100*time.Millisecond, 0)
+
+	old := exec.Command("sleep", "10")
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	generations.Add([]int{old.Process.Pid}, "a")
+	generations.Add([]int{1}, "b")
+
+	finished := make(chan error, 1)
+	go func() { finished <- old.Wait() }()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		old.Process.Kill()
+		t.Fatal("draining process expected to be stopped")
+	}
+	status := old.ProcessState.Sys().(syscall.WaitStatus)
+	generations.Finish(old.Process.Pid, &status)
+
+	list := generations.Generations()
+	if !list[0].HardStopped || list[0].State != GenerationFinished {
+		t.Fatalf("generation expected to be hard-stopped, found %+v", list[0])
+	}
+	if p := list[0].Processes[0]; p.Signal != syscall.SIGTERM.String() {
+		t.Fatalf("process expected to be terminated, found %+v", p)
+	}
+}
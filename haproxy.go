@@ -16,7 +16,14 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
 const (
@@ -32,50 +39,200 @@ type HaproxyServer interface {
 	IsRunning() bool
 }
 
-func NewHaproxyServer(path, pidFile, configFile, mode string) (HaproxyServer, error) {
+// HaproxyReloadPlan describes what a haproxy manager would do to reload the
+// configuration: the command it would run and the processes it would signal.
+type HaproxyReloadPlan struct {
+	Action  string   `json:"action"`
+	Command []string `json:"command,omitempty"`
+	Signal  string   `json:"signal,omitempty"`
+	Pids    []int    `json:"pids,omitempty"`
+}
+
+// A HaproxyReloadPlanner can report what a reload would do without doing it.
+type HaproxyReloadPlanner interface {
+	PlanReload() (*HaproxyReloadPlan, error)
+}
+
+// A HaproxySignaler can send signals to haproxy processes
+type HaproxySignaler interface {
+	Signal(signal os.Signal) error
+}
+
+// StopGracefully asks haproxy to stop once current connections are finished,
+// and waits for it to stop up to timeout.
+func StopGracefully(haproxy HaproxyServer, timeout time.Duration) error {
+	signaler, ok := haproxy.(HaproxySignaler)
+	if !ok {
+		return fmt.Errorf("haproxy server cannot be signaled")
+	}
+	if err := signaler.Signal(syscall.SIGUSR1); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for haproxy.IsRunning() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("haproxy still running after %s", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// A HaproxyConfigHasher registers the processes it starts with the hash of
+// their configuration, as calculated by the reloader, that can render it
+// from a template.
+type HaproxyConfigHasher interface {
+	SetConfigHash(hash string)
+}
+
+// A HaproxyNetQueueConfigurer retains connections during reloads, and can
+// change the IPs where they are retained without restarting haproxy.
+type HaproxyNetQueueConfigurer interface {
+	SetNetQueueIPs(ips []net.IP) error
+}
+
+// NewHaproxyServer returns a manager for haproxy in the given mode, haproxy
+// standard output and error are written to output, lifecycle events are
+// published in events, and processes are registered in generations.
+func NewHaproxyServer(path, pidFile string, configFiles []string, mode string, output io.Writer, events *EventBus, generations *HaproxyGenerations) (HaproxyServer, error) {
 	switch mode {
 	case "daemon":
 		return &HaproxyServerDaemon{
-			path:       path,
-			pidFile:    pidFile,
-			configFile: configFile,
+			path:        path,
+			pidFile:     pidFile,
+			configFiles: configFiles,
+			output:      output,
+			events:      events,
+			generations: generations,
 		}, nil
 	case "master-worker":
 		return &HaproxyServerMasterWorker{
-			path:       path,
-			pidFile:    pidFile,
-			configFile: configFile,
+			path:        path,
+			pidFile:     pidFile,
+			configFiles: configFiles,
+			output:      output,
+			events:      events,
+			generations: generations,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown haproxy mode: %s", mode)
 	}
 }
 
+// configArgs returns the arguments needed to pass the configuration files or
+// directories to haproxy.
+func configArgs(configFiles []string) []string {
+	args := make([]string, 0, 2*len(configFiles))
+	for _, f := range configFiles {
+		args = append(args, "-f", f)
+	}
+	return args
+}
+
 // A HaproxyConfigValidator can be used to validate haproxy's configuration
 // to ensure haproxy will be able to reload successfully.
 type HaproxyConfigValidator interface {
-	// Validate returns an error if haproxy has an unusable configuration.
-	Validate() error
+	// Validate returns the problems found in haproxy configuration, and an
+	// error if it is unusable.
+	Validate() (ValidationResult, error)
+}
+
+// A HaproxyContentValidator can validate configurations that are not in use.
+type HaproxyContentValidator interface {
+	// ValidateContent validates a configuration that would replace the
+	// current one.
+	ValidateContent(config []byte) (ValidationResult, error)
 }
 
 // HaproxyDashC validates haproxy configuration by running haproxy -c.
 type HaproxyDashC struct {
-	path       string
-	configFile string
+	path        string
+	configFiles []string
+	strict      bool
 }
 
 // NewHaproxyDashC implements HaproxyConfigValidator by running haproxy -c to
-// to validate haproxy config.
-func NewHaproxyDashC(path, configFile string) *HaproxyDashC {
-	return &HaproxyDashC{path: path, configFile: configFile}
+// to validate haproxy config. In strict mode warnings are also considered
+// errors.
+func NewHaproxyDashC(path string, configFiles []string, strict bool) *HaproxyDashC {
+	return &HaproxyDashC{path: path, configFiles: configFiles, strict: strict}
 }
 
-// Validate returns an error if haproxy has an unusable configuration.
-func (v *HaproxyDashC) Validate() error {
-	args := []string{"-c", "-q", "-f", v.configFile}
+// Validate returns the problems found in haproxy configuration, and an error
+// if it is unusable.
+func (v *HaproxyDashC) Validate() (ValidationResult, error) {
+	return v.check(v.configFiles, "")
+}
+
+// ValidateContent validates a configuration that would replace the first
+// configuration file, without modifying it. It is validated from the
+// directory of the replaced file, so relative paths are resolved there.
+func (v *HaproxyDashC) ValidateContent(config []byte) (ValidationResult, error) {
+	dir, err := ioutil.TempDir("", "haproxy-validate")
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	configFiles, err := replaceConfigFile(v.configFiles, config, dir)
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	replaced, err := filepath.Abs(v.configFiles[0])
+	if err != nil {
+		return ValidationResult{}, err
+	}
+
+	result, err := v.check(configFiles, filepath.Dir(replaced))
+	for i := range result.Items {
+		if result.Items[i].File == configFiles[0] {
+			result.Items[i].File = v.configFiles[0]
+		}
+	}
+	return result, err
+}
+
+// replaceConfigFile writes config in dir and returns the configuration files
+// with it in place of the first one. All paths are absolute, so they can be
+// used from other directories. The first configuration file cannot be a
+// directory, as a single file cannot replace it.
+func replaceConfigFile(configFiles []string, config []byte, dir string) ([]string, error) {
+	if len(configFiles) == 0 {
+		return nil, fmt.Errorf("no configuration file to replace")
+	}
+	if info, err := os.Stat(configFiles[0]); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("cannot replace configuration directory %s with a single file", configFiles[0])
+	}
+
+	files := make([]string, len(configFiles))
+	for i, f := range configFiles {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = abs
+	}
+
+	files[0] = filepath.Join(dir, filepath.Base(files[0]))
+	if err := ioutil.WriteFile(files[0], config, 0600); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (v *HaproxyDashC) check(configFiles []string, dir string) (ValidationResult, error) {
+	args := append([]string{"-c"}, configArgs(configFiles)...)
 	command := exec.Command(v.path, args...)
-	if out, err := command.CombinedOutput(); err != nil {
-		return fmt.Errorf("%v:\n%s", err, out)
+	command.Dir = dir
+	out, err := reaper.CombinedOutput(command)
+
+	result := ValidationResult{Items: parseHaproxyCheckOutput(string(out))}
+	if err != nil {
+		return result, fmt.Errorf("%v:\n%s", err, out)
 	}
-	return nil
+	if v.strict && result.HasSeverity(ValidationWarning) {
+		return result, fmt.Errorf("configuration has warnings:\n%s", out)
+	}
+	result.Valid = true
+	return result, nil
 }
@@ -0,0 +1,286 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var haproxySectionKeywords = map[string]bool{
+	"global":      true,
+	"defaults":    true,
+	"frontend":    true,
+	"backend":     true,
+	"listen":      true,
+	"peers":       true,
+	"resolvers":   true,
+	"userlist":    true,
+	"mailers":     true,
+	"cache":       true,
+	"program":     true,
+	"http-errors": true,
+	"ring":        true,
+}
+
+// ConfigLine is a non-empty line in haproxy configuration, without comments
+type ConfigLine struct {
+	File   string
+	Number int
+	Fields []string
+}
+
+func (l ConfigLine) String() string {
+	return strings.Join(l.Fields, " ")
+}
+
+// Keyword returns the first field of the line
+func (l ConfigLine) Keyword() string {
+	return l.Fields[0]
+}
+
+// HasField returns true if the line contains the given field
+func (l ConfigLine) HasField(field string) bool {
+	for _, f := range l.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigSection is a section in haproxy configuration, as global or a
+// backend
+type ConfigSection struct {
+	Type  string
+	Name  string
+	File  string
+	Line  int
+	Lines []ConfigLine
+}
+
+// Find returns the lines starting with the given keywords
+func (s *ConfigSection) Find(keywords ...string) []ConfigLine {
+	var lines []ConfigLine
+	for _, line := range s.Lines {
+		if len(line.Fields) < len(keywords) {
+			continue
+		}
+		found := true
+		for i := range keywords {
+			if line.Fields[i] != keywords[i] {
+				found = false
+				break
+			}
+		}
+		if found {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// HaproxyConfig is a minimal representation of haproxy configuration, it is
+// not a full parser, but it is enough to reason about sections and keywords.
+type HaproxyConfig struct {
+	Sections []*ConfigSection
+}
+
+// SectionsOf returns the sections of the given types
+func (c *HaproxyConfig) SectionsOf(types ...string) []*ConfigSection {
+	var sections []*ConfigSection
+	for _, s := range c.Sections {
+		for _, t := range types {
+			if s.Type == t {
+				sections = append(sections, s)
+				break
+			}
+		}
+	}
+	return sections
+}
+
+// DefaultsFor returns the defaults section that applies to the given section,
+// that is the last one defined before it.
+func (c *HaproxyConfig) DefaultsFor(section *ConfigSection) *ConfigSection {
+	var defaults *ConfigSection
+	for _, s := range c.Sections {
+		if s == section {
+			break
+		}
+		if s.Type == "defaults" {
+			defaults = s
+		}
+	}
+	return defaults
+}
+
+// Options whose argument is a file, and the global keyword with the base
+// directory used to resolve them if relative
+var haproxyFileOptions = map[string]string{
+	"crt":               "crt-base",
+	"crt-list":          "crt-base",
+	"ca-file":           "ca-base",
+	"crl-file":          "ca-base",
+	"-f":                "",
+	"file":              "",
+	"lf-file":           "",
+	"lua-load":          "",
+	"ssl-dh-param-file": "",
+}
+
+// Converters and actions using map or ACL files, as in map_str(/etc/hosts.map)
+var haproxyMapFileRegexp = regexp.MustCompile(`(?:map(?:_\w+)?|-acl)\(([^,)]+)`)
+
+// ReferencedFiles returns the files referenced from the configuration, as
+// certificates, maps, ACL files or error files.
+func (c *HaproxyConfig) ReferencedFiles() []string {
+	bases := make(map[string]string)
+	for _, section := range c.SectionsOf("global") {
+		for _, line := range section.Lines {
+			if (line.Keyword() == "crt-base" || line.Keyword() == "ca-base") && len(line.Fields) > 1 {
+				bases[line.Keyword()] = line.Fields[1]
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	add := func(path, base string) {
+		if !filepath.IsAbs(path) && len(bases[base]) > 0 {
+			path = filepath.Join(bases[base], path)
+		}
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	for _, section := range c.Sections {
+		for _, line := range section.Lines {
+			if line.Keyword() == "errorfile" && len(line.Fields) > 2 {
+				add(line.Fields[2], "")
+			}
+			for i, field := range line.Fields {
+				if base, found := haproxyFileOptions[field]; found && i+1 < len(line.Fields) {
+					add(line.Fields[i+1], base)
+				}
+				for _, m := range haproxyMapFileRegexp.FindAllStringSubmatch(field, -1) {
+					add(m[1], "")
+				}
+			}
+		}
+	}
+	return files
+}
+
+func stripComment(line string) string {
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parse adds the sections found in r to the configuration
+func (c *HaproxyConfig) parse(r io.Reader, file string) error {
+	var current *ConfigSection
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if haproxySectionKeywords[fields[0]] {
+			current = &ConfigSection{Type: fields[0], File: file, Line: n}
+			if len(fields) > 1 {
+				current.Name = fields[1]
+			}
+			c.Sections = append(c.Sections, current)
+			continue
+		}
+		if current == nil {
+			// Lines out of any section are ignored
+			continue
+		}
+		current.Lines = append(current.Lines, ConfigLine{File: file, Number: n, Fields: fields})
+	}
+	return scanner.Err()
+}
+
+// ParseHaproxyConfig parses configuration from a reader
+func ParseHaproxyConfig(r io.Reader, file string) (*HaproxyConfig, error) {
+	c := &HaproxyConfig{}
+	if err := c.parse(r, file); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseHaproxyConfigFiles parses configuration from files and directories as
+// haproxy does, only files with .cfg extension are read from directories.
+// If replacement is not nil, it is used as the content of the first file.
+func ParseHaproxyConfigFiles(configFiles []string, replacement []byte) (*HaproxyConfig, error) {
+	c := &HaproxyConfig{}
+	for i, path := range configFiles {
+		if i == 0 && replacement != nil {
+			if err := c.parse(bytes.NewReader(replacement), path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		files, err := listFiles([]string{path})
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			files = filterConfigFiles(files)
+		}
+		for _, file := range files {
+			d, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.parse(bytes.NewReader(d), file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func filterConfigFiles(files []string) []string {
+	var filtered []string
+	for _, f := range files {
+		if filepath.Ext(f) == ".cfg" {
+			filtered = append(filtered, f)
+		}
+	}
+	sort.Strings(filtered)
+	return filtered
+}
@@ -0,0 +1,49 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const referencedFilesConfig = `
+global
+  crt-base /etc/ssl/certs
+  lua-load /etc/haproxy/auth.lua
+
+frontend https
+  bind :443 ssl crt site.pem ca-file /etc/ssl/ca.pem
+  acl blocked src -f /etc/haproxy/blocked.lst
+  http-request set-map(/etc/haproxy/dynamic.map) %[src] 1
+  use_backend %[req.hdr(host),lower,map_str(/etc/haproxy/hosts.map,default)]
+  errorfile 503 /etc/haproxy/errors/503.http
+`
+
+func TestReferencedFiles(t *testing.T) {
+	expected := []string{
+		"/etc/haproxy/auth.lua",
+		"/etc/ssl/certs/site.pem",
+		"/etc/ssl/ca.pem",
+		"/etc/haproxy/blocked.lst",
+		"/etc/haproxy/dynamic.map",
+		"/etc/haproxy/hosts.map",
+		"/etc/haproxy/errors/503.http",
+	}
+	files := parseTestConfig(t, referencedFilesConfig).ReferencedFiles()
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected:\n%v\nfound:\n%v", expected, files)
+	}
+}
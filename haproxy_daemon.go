@@ -18,7 +18,9 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
@@ -39,13 +41,21 @@ type HaproxyServerDaemon struct {
 	sync.Mutex
 	reloading sync.Mutex
 	state     int
+	stopping  bool
 	netQueue  NetQueue
 
-	path, pidFile, configFile string
+	// Hash of the configuration of the next processes started
+	configHash string
+
+	path, pidFile string
+	configFiles   []string
+	output        io.Writer
+	events        *EventBus
+	generations   *HaproxyGenerations
 }
 
 func (s *HaproxyServerDaemon) buildCommand(reload bool) *exec.Cmd {
-	args := []string{"-D", "-f", s.configFile, "-p", s.pidFile}
+	args := append([]string{"-D", "-p", s.pidFile}, configArgs(s.configFiles)...)
 
 	if reload && s.IsRunning() {
 		pids, _ := s.Pids()
@@ -57,11 +67,24 @@ func (s *HaproxyServerDaemon) buildCommand(reload bool) *exec.Cmd {
 		args = append(args, pidArgs...)
 	}
 	cmd := exec.Command(s.path, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+	cmd.Stdout = s.output
+	cmd.Stderr = s.output
 	return cmd
 }
 
+// PlanReload returns the command that would be run to reload haproxy, and
+// the pids of the processes that would receive -sf.
+func (s *HaproxyServerDaemon) PlanReload() (*HaproxyReloadPlan, error) {
+	if !s.IsRunning() {
+		return &HaproxyReloadPlan{Action: "start", Command: s.buildCommand(false).Args}, nil
+	}
+	pids, err := s.Pids()
+	if err != nil {
+		return nil, err
+	}
+	return &HaproxyReloadPlan{Action: "reload", Command: s.buildCommand(true).Args, Pids: pids}, nil
+}
+
 func (s *HaproxyServerDaemon) Pids() ([]int, error) {
 	var pids []int
 
@@ -95,8 +118,19 @@ func (s *HaproxyServerDaemon) Pid() int {
 	return pids[0]
 }
 
+// Signal sends a signal to the current haproxy process, signals that stop
+// haproxy are not reported as crashes.
 func (s *HaproxyServerDaemon) Signal(signal os.Signal) error {
-	p, err := os.FindProcess(s.Pid())
+	pid := s.Pid()
+	if pid == 0 {
+		// Signaling pid 0 would signal the whole process group
+		return fmt.Errorf("haproxy pid not found")
+	}
+	switch signal {
+	case syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT:
+		s.setStopping(true)
+	}
+	p, err := os.FindProcess(pid)
 	if err != nil {
 		return err
 	}
@@ -125,24 +159,107 @@ func (s *HaproxyServerDaemon) Start() error {
 	if err != nil {
 		log.Fatalf("Expected comma-separated list of IPs: %v", err)
 	}
-	s.netQueue = NewNetQueue(nfQueueNumber, ips)
+	s.netQueue = NewNetQueue(nfQueueNumber, ips, s.events)
+	s.setStopping(false)
 
 	cmd := s.buildCommand(false)
-	if err := cmd.Start(); err != nil {
+	if err := reaper.Run(cmd); err != nil {
 		return err
 	}
-	return cmd.Wait()
+	s.track()
+	s.events.Publish(EventHaproxyStarted, map[string]interface{}{"pid": s.Pid()})
+	return nil
+}
+
+func (s *HaproxyServerDaemon) setStopping(stopping bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.stopping = stopping
+}
+
+// SetConfigHash sets the hash registered with the next processes started
+func (s *HaproxyServerDaemon) SetConfigHash(hash string) {
+	s.Lock()
+	defer s.Unlock()
+	s.configHash = hash
+}
+
+// expectedExit returns true if current processes can finish because haproxy
+// is being stopped or reloaded
+func (s *HaproxyServerDaemon) expectedExit() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.stopping || s.state != StateIdle
+}
+
+// track registers the processes in the pid file as a new generation, and
+// waits for them to finish. Processes of the active generation finishing
+// while haproxy is not stopped nor reloaded are reported as crashes.
+func (s *HaproxyServerDaemon) track() {
+	pids, err := s.Pids()
+	if err != nil {
+		log.Printf("Couldn't read haproxy pids: %v\n", err)
+		return
+	}
+	s.Lock()
+	hash := s.configHash
+	s.Unlock()
+	generation := s.generations.Add(pids, hash)
+	for _, pid := range pids {
+		reaper.Hold(pid)
+		go func(pid int) {
+			defer reaper.Release(pid)
+			status := reaper.WaitProcess(pid)
+			state := s.generations.Finish(pid, status)
+			data := map[string]interface{}{"pid": pid}
+			if generation != nil {
+				data["generation"] = generation.ID
+			}
+			if status != nil {
+				data["exit_status"] = status.ExitStatus()
+			}
+			switch {
+			case state == GenerationDraining:
+				log.Printf("Old process with pid %d finished\n", pid)
+				s.events.Publish(EventOldProcessFinished, data)
+			case state == GenerationActive && !s.expectedExit():
+				log.Printf("Haproxy process with pid %d finished unexpectedly\n", pid)
+				s.events.Publish(EventHaproxyCrashed, data)
+			}
+		}(pid)
+	}
 }
 
 func (s *HaproxyServerDaemon) Stop() error {
 	if !s.IsRunning() {
 		return fmt.Errorf("Server not started")
 	}
+	pid := s.Pid()
+	s.setStopping(true)
 	err := s.Kill()
 	if err != nil {
 		return fmt.Errorf("Couldn't kill process: %v", err)
 	}
 	s.netQueue.Stop()
+	s.events.Publish(EventHaproxyStopped, map[string]interface{}{"pid": pid})
+	return nil
+}
+
+// SetNetQueueIPs changes the IPs where connections are retained during
+// reloads, it waits for any running reload to finish.
+func (s *HaproxyServerDaemon) SetNetQueueIPs(ips []net.IP) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	if s.netQueue == nil {
+		// Not started yet, IPs are read on start
+		return nil
+	}
+	if _, dummy := s.netQueue.(*dummyNetQueue); dummy && len(ips) > 0 {
+		s.netQueue = NewNetQueue(nfQueueNumber, ips, s.events)
+		return nil
+	}
+	s.netQueue.SetIPs(ips)
 	return nil
 }
 
@@ -181,19 +298,17 @@ func (s *HaproxyServerDaemon) Reload() error {
 	s.reloading.Lock()
 	defer s.reloading.Unlock()
 
-	currentPids, _ := s.Pids()
-
 	start := time.Now()
 	err := func() error {
 		cmd := s.buildCommand(s.IsRunning())
 
-		netQueue.Capture()
-		defer netQueue.Release()
+		s.netQueue.Capture()
+		defer s.netQueue.Release()
 
-		if err := cmd.Start(); err != nil {
+		if err := reaper.Start(cmd); err != nil {
 			return err
 		}
-		if err := cmd.Wait(); err != nil {
+		if err := reaper.Wait(cmd); err != nil {
 			return fmt.Errorf("Haproxy couldn't reload configuration: %v", err)
 		}
 		return nil
@@ -202,21 +317,7 @@ func (s *HaproxyServerDaemon) Reload() error {
 		return err
 	}
 	log.Printf("Reload took %s", time.Since(start))
-
-	for _, pid := range currentPids {
-		p, err := os.FindProcess(pid)
-		if err != nil {
-			// This shouldn't happen in UNIX systems
-			log.Printf("os.FindProcess(%d) failed, this shouldn't happen: %v\n", pid, err)
-			continue
-		}
-		go func() {
-			if _, err := p.Wait(); err != nil {
-				log.Printf("Cannot wait for old haproxy: %v\n", err)
-			}
-			log.Printf("Old process with pid %d finished\n", p.Pid)
-		}()
-	}
+	s.track()
 
 	log.Println("Haproxy reloaded with pid", s.Pid())
 	return nil
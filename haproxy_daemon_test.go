@@ -0,0 +1,93 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeHaproxyDaemonScript starts a background process and writes its pid in
+// the pid file, as haproxy -D -p <pidfile> does
+const fakeHaproxyDaemonScript = `#!/bin/sh
+sleep 30 >/dev/null 2>&1 &
+echo $! > "$3"
+`
+
+func waitForEvent(events <-chan Event, eventType string, timeout time.Duration) (Event, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == eventType {
+				return e, true
+			}
+		case <-deadline:
+			return Event{}, false
+		}
+	}
+}
+
+func TestHaproxyDaemonCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "haproxy")
+	ioutil.WriteFile(path, []byte(fakeHaproxyDaemonScript), 0755)
+	config := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(config, []byte("global\n"), 0644)
+
+	events := NewEventBus()
+	received, cancel := events.Subscribe()
+	defer cancel()
+
+	s := &HaproxyServerDaemon{
+		path:        path,
+		pidFile:     filepath.Join(dir, "haproxy.pid"),
+		configFiles: []string{config},
+		events:      events,
+		generations: NewHaproxyGenerations(0, 0),
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := s.Pid()
+	syscall.Kill(pid, syscall.SIGKILL)
+	e, found := waitForEvent(received, EventHaproxyCrashed, 5*time.Second)
+	if !found {
+		t.Fatal("crash expected to be reported")
+	}
+	if e.Data["pid"] != pid {
+		t.Fatalf("crash of %d expected, found %v", pid, e.Data)
+	}
+
+	// Stopped processes are not reported as crashes
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := waitForEvent(received, EventHaproxyCrashed, 2*processPollInterval); found {
+		t.Fatal("stopped haproxy reported as crashed")
+	}
+}
@@ -16,16 +16,25 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 )
 
 type HaproxyServerMasterWorker struct {
-	command *exec.Cmd
+	sync.Mutex
+	command    *exec.Cmd
+	stopping   bool
+	configHash string
 
-	path, pidFile, configFile string
+	path, pidFile string
+	configFiles   []string
+	output        io.Writer
+	events        *EventBus
+	generations   *HaproxyGenerations
 }
 
 func (s *HaproxyServerMasterWorker) IsRunning() bool {
@@ -47,33 +56,102 @@ func (s *HaproxyServerMasterWorker) Reload() error {
 	return nil
 }
 
+// PlanReload returns the command that would be run if haproxy is not running,
+// or the pid of the master process that would be signaled otherwise.
+func (s *HaproxyServerMasterWorker) PlanReload() (*HaproxyReloadPlan, error) {
+	if !s.IsRunning() {
+		return &HaproxyReloadPlan{Action: "start", Command: append([]string{s.path}, s.args()...)}, nil
+	}
+	return &HaproxyReloadPlan{Action: "reload", Signal: "SIGUSR2", Pids: []int{s.command.Process.Pid}}, nil
+}
+
+func (s *HaproxyServerMasterWorker) args() []string {
+	return append([]string{"-W", "-p", s.pidFile}, configArgs(s.configFiles)...)
+}
+
 func (s *HaproxyServerMasterWorker) Start() error {
 	if s.IsRunning() {
 		return fmt.Errorf("server already started")
 	}
-	args := []string{"-W", "-f", s.configFile, "-p", s.pidFile}
-	s.command = exec.Command(s.path, args...)
-	s.command.Stdout = os.Stdout
-	s.command.Stderr = os.Stdout
-	if err := s.command.Start(); err != nil {
+	s.command = exec.Command(s.path, s.args()...)
+	s.command.Stdout = s.output
+	s.command.Stderr = s.output
+	if err := reaper.Start(s.command); err != nil {
 		return err
 	}
+	pid := s.command.Process.Pid
+	s.events.Publish(EventHaproxyStarted, map[string]interface{}{"pid": pid})
+
+	// Master process is the only one tracked, workers are replaced by
+	// the master itself on reloads, so they are not registered in the
+	// generations, and they are not hard-stopped by the wrapper
+	s.Lock()
+	s.stopping = false
+	hash := s.configHash
+	s.Unlock()
+	s.generations.Add([]int{pid}, hash)
 
-	go func() {
-		err := s.command.Wait()
+	go func(command *exec.Cmd) {
+		err := reaper.Wait(command)
 		if err != nil {
 			log.Printf("Haproxy finished with error: %v", err)
 		} else {
 			log.Println("Haproxy finished")
 		}
-	}()
+		var status *syscall.WaitStatus
+		if command.ProcessState != nil {
+			if ws, ok := command.ProcessState.Sys().(syscall.WaitStatus); ok {
+				status = &ws
+			}
+		}
+		s.generations.Finish(pid, status)
+
+		s.Lock()
+		stopping := s.stopping
+		s.Unlock()
+		if stopping {
+			s.events.Publish(EventHaproxyStopped, map[string]interface{}{"pid": pid})
+			return
+		}
+		data := map[string]interface{}{"pid": pid}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		s.events.Publish(EventHaproxyCrashed, data)
+	}(s.command)
 	return nil
 }
 
+// SetConfigHash sets the hash registered with the master process when it is
+// started.
+func (s *HaproxyServerMasterWorker) SetConfigHash(hash string) {
+	s.Lock()
+	defer s.Unlock()
+	s.configHash = hash
+}
+
+// Signal sends a signal to the master process, signals that stop haproxy are
+// not reported as crashes.
+func (s *HaproxyServerMasterWorker) Signal(signal os.Signal) error {
+	if !s.IsRunning() {
+		return fmt.Errorf("server is not running")
+	}
+	switch signal {
+	case syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT:
+		s.Lock()
+		s.stopping = true
+		s.Unlock()
+	}
+	return s.command.Process.Signal(signal)
+}
+
 func (s *HaproxyServerMasterWorker) Stop() error {
 	if !s.IsRunning() {
 		return fmt.Errorf("server is not running")
 	}
+	s.Lock()
+	s.stopping = true
+	s.Unlock()
 	err := s.command.Process.Kill()
 	if err != nil {
 		return fmt.Errorf("couldn't kill server")
@@ -0,0 +1,130 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// ReadinessCheck is the result of one of the checks of readiness, checks
+// failing during the grace period after a reload don't make haproxy not
+// ready.
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Grace bool   `json:"grace,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Readiness checks if haproxy is ready to receive traffic
+type Readiness struct {
+	reloader    *Reloader
+	address     string
+	statsSocket string
+	grace       time.Duration
+}
+
+// NewReadiness returns a readiness checker, address and statsSocket are
+// optional, if set they are checked to accept connections.
+func NewReadiness(reloader *Reloader, address, statsSocket string, grace time.Duration) *Readiness {
+	return &Readiness{
+		reloader:    reloader,
+		address:     address,
+		statsSocket: statsSocket,
+		grace:       grace,
+	}
+}
+
+// Check returns if haproxy is ready, and the result of each check
+func (r *Readiness) Check() (bool, []ReadinessCheck) {
+	status := r.reloader.ReloadStatus()
+	inGrace := status.Reloading || time.Since(status.LastFinished) < r.grace
+
+	var checks []ReadinessCheck
+	add := func(name string, err error, graceable bool) {
+		check := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+			check.Grace = graceable && inGrace
+		}
+		checks = append(checks, check)
+	}
+
+	var err error
+	if !r.reloader.haproxy.IsRunning() {
+		err = fmt.Errorf("haproxy not running")
+	}
+	add("haproxy", err, true)
+
+	err = nil
+	if len(status.LastError) > 0 {
+		err = fmt.Errorf("last reload failed: %s", status.LastError)
+	}
+	add("reload", err, false)
+
+	if len(r.address) > 0 {
+		add("address", checkTCP(r.address), true)
+	}
+	if len(r.statsSocket) > 0 {
+		add("stats_socket", checkStatsSocket(r.statsSocket), true)
+	}
+
+	ready := true
+	for _, check := range checks {
+		if !check.OK && !check.Grace {
+			ready = false
+		}
+	}
+	return ready, checks
+}
+
+func checkTCP(address string) error {
+	conn, err := net.DialTimeout("tcp", address, readinessCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkStatsSocket checks that haproxy answers commands in its stats socket
+func checkStatsSocket(path string) error {
+	response, err := NewRuntimeAPI(path, readinessCheckTimeout).Execute("show info")
+	if err != nil {
+		return err
+	}
+	if len(response) == 0 {
+		return fmt.Errorf("empty response from stats socket")
+	}
+	return nil
+}
+
+// ServeHTTP replies with the result of the checks, with status 503 if haproxy
+// is not ready.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ready, checks := r.Check()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"ready":  ready,
+		"checks": checks,
+	})
+}
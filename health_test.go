@@ -0,0 +1,130 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingHaproxy is a fake haproxy server whose reloads fail
+type failingHaproxy struct {
+	fakeHaproxy
+}
+
+func (h *failingHaproxy) Reload() error {
+	return fmt.Errorf("reload failed")
+}
+
+func checkNames(checks []ReadinessCheck) map[string]ReadinessCheck {
+	m := make(map[string]ReadinessCheck)
+	for _, c := range checks {
+		m[c.Name] = c
+	}
+	return m
+}
+
+func TestReadiness(t *testing.T) {
+	haproxy := &failingHaproxy{}
+	reloader := NewReloader(haproxy, nil, &fakeValidator{}, nil, nil)
+	readiness := NewReadiness(reloader, "", "", time.Hour)
+
+	if ready, checks := readiness.Check(); ready {
+		t.Fatalf("haproxy not running shouldn't be ready: %+v", checks)
+	}
+
+	reloader.Start()
+	if ready, checks := readiness.Check(); !ready {
+		t.Fatalf("haproxy running should be ready: %+v", checks)
+	}
+
+	reloader.Reload(true)
+	ready, checks := readiness.Check()
+	if ready || checkNames(checks)["reload"].OK {
+		t.Fatalf("haproxy shouldn't be ready after failed reload: %+v", checks)
+	}
+}
+
+func TestReadinessGrace(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	haproxy := &fakeHaproxy{}
+	reloader := NewReloader(haproxy, nil, &fakeValidator{}, nil, nil)
+	reloader.Start()
+
+	// Not listening, and no reload yet
+	if ready, checks := NewReadiness(reloader, address, "", time.Hour).Check(); ready {
+		t.Fatalf("haproxy shouldn't be ready if address doesn't accept connections: %+v", checks)
+	}
+
+	// Failing checks are tolerated after a reload
+	reloader.Reload(true)
+	ready, checks := NewReadiness(reloader, address, "", time.Hour).Check()
+	if !ready || !checkNames(checks)["address"].Grace {
+		t.Fatalf("haproxy should be ready in grace period: %+v", checks)
+	}
+	if ready, checks := NewReadiness(reloader, address, "", 0).Check(); ready {
+		t.Fatalf("haproxy shouldn't be ready after grace period: %+v", checks)
+	}
+}
+
+func TestReadinessStatsSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "stats.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 64)
+			conn.Read(buf)
+			conn.Write([]byte("Name: HAProxy\n"))
+			conn.Close()
+		}
+	}()
+
+	haproxy := &fakeHaproxy{}
+	reloader := NewReloader(haproxy, nil, &fakeValidator{}, nil, nil)
+	reloader.Start()
+
+	if ready, checks := NewReadiness(reloader, "", socket, 0).Check(); !ready {
+		t.Fatalf("haproxy should be ready: %+v", checks)
+	}
+	missing := filepath.Join(dir, "missing.sock")
+	if ready, checks := NewReadiness(reloader, "", missing, 0).Check(); ready {
+		t.Fatalf("haproxy shouldn't be ready without stats socket: %+v", checks)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const httpConfigSourceTimeout = 30 * time.Second
+
+// HTTPConfigSourceStatus contains information about the last polls of an
+// HTTP configuration source
+type HTTPConfigSourceStatus struct {
+	URL           string    `json:"url"`
+	ETag          string    `json:"etag,omitempty"`
+	LastModified  string    `json:"last_modified,omitempty"`
+	LastPoll      time.Time `json:"last_poll"`
+	LastChange    time.Time `json:"last_change"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	RejectedETag  string    `json:"rejected_etag,omitempty"`
+}
+
+// HTTPConfigSource periodically fetches haproxy configuration from an URL,
+// and reloads haproxy when it changes and it is valid. Configuration is
+// validated before writing it, so the target file is never invalid.
+type HTTPConfigSource struct {
+	sync.Mutex
+
+	url      string
+	target   string
+	interval time.Duration
+
+	jobs      *ReloadJobs
+	validator HaproxyConfigValidator
+	template  *ConfigTemplate
+	client    *http.Client
+
+	done chan struct{}
+
+	// Status has its own lock so it can be read during polls
+	statusLock sync.Mutex
+	status     HTTPConfigSourceStatus
+
+	// Last rejected version, so it is not validated again on every poll
+	rejectedHash  [sha256.Size]byte
+	rejectedError error
+}
+
+// NewHTTPConfigSource returns a source that writes the configuration
+// obtained from url in the target file. If template is not nil, the target
+// is the template source, and configuration is rendered before validating it.
+func NewHTTPConfigSource(url, target string, interval time.Duration, jobs *ReloadJobs, validator HaproxyConfigValidator, template *ConfigTemplate) *HTTPConfigSource {
+	return &HTTPConfigSource{
+		url:       url,
+		target:    target,
+		interval:  interval,
+		jobs:      jobs,
+		validator: validator,
+		template:  template,
+		client:    &http.Client{Timeout: httpConfigSourceTimeout},
+		status:    HTTPConfigSourceStatus{URL: url},
+	}
+}
+
+// Start polls the source for the first time and then keeps polling it
+// periodically.
+func (s *HTTPConfigSource) Start() error {
+	if s.done != nil {
+		return fmt.Errorf("source already started")
+	}
+	if err := s.Poll(); err != nil {
+		log.Printf("Couldn't obtain configuration from %s: %v\n", s.url, err)
+	}
+
+	s.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			if err := s.Poll(); err != nil {
+				log.Printf("Couldn't obtain configuration from %s: %v\n", s.url, err)
+			}
+		}
+	}(s.done)
+	return nil
+}
+
+func (s *HTTPConfigSource) Stop() error {
+	if s.done == nil {
+		return fmt.Errorf("source not started")
+	}
+	close(s.done)
+	s.done = nil
+	return nil
+}
+
+// Poll fetches the configuration and applies it if it has changed.
+func (s *HTTPConfigSource) Poll() error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	err := s.poll()
+	s.setStatus(func(status *HTTPConfigSourceStatus) {
+		status.LastPoll = now
+		if err != nil {
+			status.LastError = err.Error()
+			status.LastErrorTime = now
+		} else {
+			status.LastError = ""
+		}
+	})
+	return err
+}
+
+func (s *HTTPConfigSource) setStatus(update func(*HTTPConfigSourceStatus)) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	update(&s.status)
+}
+
+func (s *HTTPConfigSource) poll() error {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	if len(s.status.ETag) > 0 {
+		req.Header.Set("If-None-Match", s.status.ETag)
+	}
+	if len(s.status.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", s.status.LastModified)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	config, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+
+	// Rejected versions are not validated again, but the error is kept
+	// visible till a new version is obtained
+	etag := resp.Header.Get("ETag")
+	hash := sha256.Sum256(config)
+	if s.rejectedError != nil && hash == s.rejectedHash {
+		return s.rejectedError
+	}
+
+	current, err := ioutil.ReadFile(s.target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil || !bytes.Equal(current, config) {
+		if err := s.apply(config); err != nil {
+			s.rejectedHash = hash
+			s.rejectedError = err
+			s.setStatus(func(status *HTTPConfigSourceStatus) {
+				status.RejectedETag = etag
+			})
+			return err
+		}
+		s.setStatus(func(status *HTTPConfigSourceStatus) {
+			status.LastChange = time.Now()
+		})
+	}
+
+	// ETag and modification time are only stored once the configuration is
+	// applied, so changes are not missed if they cannot be applied.
+	s.rejectedError = nil
+	s.setStatus(func(status *HTTPConfigSourceStatus) {
+		status.RejectedETag = ""
+		status.ETag = etag
+		status.LastModified = resp.Header.Get("Last-Modified")
+	})
+	return nil
+}
+
+// apply validates the new configuration in memory, and writes it and reloads
+// haproxy only if it is valid.
+func (s *HTTPConfigSource) apply(config []byte) error {
+	rendered := config
+	if s.template != nil {
+		var err error
+		if rendered, err = s.template.ExecuteContent(config); err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+	}
+	validator, ok := s.validator.(HaproxyContentValidator)
+	if !ok {
+		return fmt.Errorf("validator doesn't support validating content")
+	}
+	if _, err := validator.ValidateContent(rendered); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if err := writeFileAtomic(s.target, config, 0600); err != nil {
+		return err
+	}
+	log.Printf("New configuration obtained from %s, reloading\n", s.url)
+	if _, err := s.jobs.Reload(false); err != nil {
+		return fmt.Errorf("couldn't reload: %v", err)
+	}
+	return nil
+}
+
+// Status returns information about the last polls
+func (s *HTTPConfigSource) Status() interface{} {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	return s.status
+}
@@ -0,0 +1,182 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testConfigServer struct {
+	sync.Mutex
+	config   string
+	etag     string
+	requests int
+	notMod   int
+}
+
+func (s *testConfigServer) Set(config, etag string) {
+	s.Lock()
+	defer s.Unlock()
+	s.config, s.etag = config, etag
+}
+
+func (s *testConfigServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	if req.Header.Get("If-None-Match") == s.etag {
+		s.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	fmt.Fprint(w, s.config)
+}
+
+func TestHTTPConfigSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "haproxy.cfg")
+
+	configServer := &testConfigServer{}
+	configServer.Set("global\n", `"v1"`)
+	server := httptest.NewServer(configServer)
+	defer server.Close()
+
+	haproxy := &fakeHaproxy{running: true}
+	validator := &fakeContentValidator{}
+	source := NewHTTPConfigSource(server.URL, target, time.Hour, NewReloadJobs(NewReloader(haproxy, []string{target}, validator, nil, nil), reloadJobsHistory), validator, nil)
+
+	if err := source.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := ioutil.ReadFile(target); string(d) != "global\n" {
+		t.Fatalf("unexpected configuration: %s", d)
+	}
+	if haproxy.Reloads() != 1 {
+		t.Fatalf("expected one reload, found %d", haproxy.Reloads())
+	}
+
+	// Not modified
+	if err := source.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if haproxy.Reloads() != 1 || configServer.notMod != 1 {
+		t.Fatalf("unexpected reload (%d) or request not conditional (%d)", haproxy.Reloads(), configServer.notMod)
+	}
+
+	// Invalid configuration keeps current one
+	validator.SetError(fmt.Errorf("invalid"))
+	configServer.Set("global\n  maxconn foo\n", `"v2"`)
+	if err := source.Poll(); err == nil {
+		t.Fatal("invalid configuration should fail")
+	}
+	if d, _ := ioutil.ReadFile(target); string(d) != "global\n" {
+		t.Fatalf("previous configuration expected, found: %s", d)
+	}
+	if string(validator.content) != "global\n  maxconn foo\n" {
+		t.Fatalf("new configuration expected to be validated, found: %s", validator.content)
+	}
+	status := source.Status().(HTTPConfigSourceStatus)
+	if len(status.LastError) == 0 || status.ETag != `"v1"` || status.RejectedETag != `"v2"` {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// Rejected version is not validated nor applied again
+	validator.SetError(nil)
+	validator.content = nil
+	if err := source.Poll(); err == nil {
+		t.Fatal("rejected configuration should keep failing")
+	}
+	if validator.content != nil || haproxy.Reloads() != 1 {
+		t.Fatalf("rejected configuration validated again")
+	}
+
+	// Valid configuration is applied
+	configServer.Set("global\n  maxconn 100\n", `"v3"`)
+	if err := source.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if haproxy.Reloads() != 2 {
+		t.Fatalf("expected two reloads, found %d", haproxy.Reloads())
+	}
+	status = source.Status().(HTTPConfigSourceStatus)
+	if len(status.LastError) != 0 || status.ETag != `"v3"` || len(status.RejectedETag) != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestHTTPConfigSourceUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	haproxy := &fakeHaproxy{running: true}
+	source := NewHTTPConfigSource(server.URL, "/nonexistent/haproxy.cfg", time.Hour, NewReloadJobs(NewReloader(haproxy, nil, &fakeValidator{}, nil, nil), reloadJobsHistory), &fakeValidator{}, nil)
+	if err := source.Poll(); err == nil {
+		t.Fatal("poll should fail")
+	}
+	if haproxy.Reloads() != 0 {
+		t.Fatal("haproxy shouldn't be reloaded")
+	}
+}
+
+func TestHTTPConfigSourceStatusDuringPoll(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		http.NotFound(w, req)
+	}))
+	defer server.Close()
+
+	haproxy := &fakeHaproxy{running: true}
+	source := NewHTTPConfigSource(server.URL, "/nonexistent/haproxy.cfg", time.Hour, NewReloadJobs(NewReloader(haproxy, nil, &fakeValidator{}, nil, nil), reloadJobsHistory), &fakeValidator{}, nil)
+	polled := make(chan error)
+	go func() { polled <- source.Poll() }()
+	defer func() {
+		close(release)
+		<-polled
+	}()
+
+	status := make(chan interface{})
+	go func() { status <- source.Status() }()
+	select {
+	case <-status:
+	case <-time.After(time.Second):
+		t.Fatal("status shouldn't wait for polls")
+	}
+}
+
+// fakeContentValidator is a fake validator that records the last validated
+// content
+type fakeContentValidator struct {
+	fakeValidator
+	content []byte
+}
+
+func (v *fakeContentValidator) ValidateContent(config []byte) (ValidationResult, error) {
+	v.content = config
+	return v.Validate()
+}
@@ -0,0 +1,211 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of reload jobs
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Number of finished reload jobs kept to be queried
+const reloadJobsHistory = 100
+
+// ReloadJob is a reload request, ServedBy is the ID of the job whose reload
+// applied it, as all jobs queued while a reload is running are served by the
+// same reload.
+type ReloadJob struct {
+	ID         string        `json:"id"`
+	State      string        `json:"state"`
+	Force      bool          `json:"force,omitempty"`
+	ServedBy   string        `json:"served_by,omitempty"`
+	ConfigHash string        `json:"config_hash,omitempty"`
+	Requested  time.Time     `json:"requested"`
+	Started    time.Time     `json:"started"`
+	Finished   time.Time     `json:"finished"`
+	Result     *ReloadResult `json:"result,omitempty"`
+
+	done chan struct{}
+}
+
+// ReloadJobs queues reload requests and coalesces the ones received while a
+// reload is running.
+type ReloadJobs struct {
+	sync.Mutex
+
+	reloader *Reloader
+	history  int
+
+	next   int
+	jobs   map[string]*ReloadJob
+	order  []string
+	queued []*ReloadJob
+	wake   chan struct{}
+}
+
+func NewReloadJobs(reloader *Reloader, history int) *ReloadJobs {
+	j := &ReloadJobs{
+		reloader: reloader,
+		history:  history,
+		jobs:     make(map[string]*ReloadJob),
+		wake:     make(chan struct{}, 1),
+	}
+	go j.loop()
+	return j
+}
+
+// Submit queues a reload, and returns the ID of its job
+func (j *ReloadJobs) Submit(force bool) string {
+	j.Lock()
+	defer j.Unlock()
+
+	j.next++
+	job := &ReloadJob{
+		ID:        strconv.Itoa(j.next),
+		State:     JobQueued,
+		Force:     force,
+		Requested: time.Now(),
+		done:      make(chan struct{}),
+	}
+	j.jobs[job.ID] = job
+	j.order = append(j.order, job.ID)
+	j.forget()
+	j.queued = append(j.queued, job)
+	j.reloader.events.Publish(EventReloadRequested, map[string]interface{}{"job": job.ID, "force": force})
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return job.ID
+}
+
+// forget removes the oldest finished jobs beyond the history, jobs queued or
+// running are kept till they finish.
+func (j *ReloadJobs) forget() {
+	excess := len(j.order) - j.history
+	if excess <= 0 {
+		return
+	}
+	order := j.order[:0]
+	for _, id := range j.order {
+		if excess > 0 && j.jobs[id].finished() {
+			delete(j.jobs, id)
+			excess--
+			continue
+		}
+		order = append(order, id)
+	}
+	j.order = order
+}
+
+func (job *ReloadJob) finished() bool {
+	return job.State == JobSucceeded || job.State == JobFailed
+}
+
+// Get returns the current state of a job
+func (j *ReloadJobs) Get(id string) (ReloadJob, bool) {
+	j.Lock()
+	defer j.Unlock()
+	job, found := j.jobs[id]
+	if !found {
+		return ReloadJob{}, false
+	}
+	return *job, true
+}
+
+// Wait waits for a job to finish and returns its final state
+func (j *ReloadJobs) Wait(id string) (ReloadJob, bool) {
+	j.Lock()
+	job, found := j.jobs[id]
+	j.Unlock()
+	if !found {
+		return ReloadJob{}, false
+	}
+	<-job.done
+	return j.get(job), true
+}
+
+// Reload submits a reload and waits for it, it returns an error if the reload
+// serving it fails
+func (j *ReloadJobs) Reload(force bool) (ReloadJob, error) {
+	job, _ := j.Wait(j.Submit(force))
+	if job.State == JobFailed {
+		return job, fmt.Errorf("%s", job.Result.Error)
+	}
+	return job, nil
+}
+
+func (j *ReloadJobs) get(job *ReloadJob) ReloadJob {
+	j.Lock()
+	defer j.Unlock()
+	return *job
+}
+
+func (j *ReloadJobs) loop() {
+	for range j.wake {
+		j.Lock()
+		batch := j.queued
+		j.queued = nil
+		force := false
+		now := time.Now()
+		for _, job := range batch {
+			job.State = JobRunning
+			job.Started = now
+			job.ServedBy = batch[0].ID
+			force = force || job.Force
+		}
+		j.Unlock()
+
+		if len(batch) == 0 {
+			continue
+		}
+		if len(batch) > 1 {
+			log.Printf("Coalescing %d reload requests in reload job %s\n", len(batch), batch[0].ID)
+			ids := make([]string, len(batch))
+			for i, job := range batch {
+				ids[i] = job.ID
+			}
+			j.reloader.events.Publish(EventReloadCoalesced, map[string]interface{}{"job": batch[0].ID, "jobs": ids})
+		}
+
+		result, err := j.reloader.Reload(force)
+
+		j.Lock()
+		now = time.Now()
+		for _, job := range batch {
+			job.State = JobSucceeded
+			if err != nil {
+				job.State = JobFailed
+			}
+			job.Finished = now
+			job.ConfigHash = result.ConfigHash
+			jobResult := result
+			job.Result = &jobResult
+			close(job.done)
+		}
+		j.Unlock()
+	}
+}
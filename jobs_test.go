@@ -0,0 +1,143 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// blockingHaproxy is a fake haproxy server whose reloads wait to be released
+type blockingHaproxy struct {
+	fakeHaproxy
+	started chan struct{}
+	release chan error
+}
+
+func (h *blockingHaproxy) Reload() error {
+	h.started <- struct{}{}
+	if err := <-h.release; err != nil {
+		return err
+	}
+	return h.fakeHaproxy.Reload()
+}
+
+func waitForJob(jobs *ReloadJobs, id, state string) (ReloadJob, error) {
+	for i := 0; i < 100; i++ {
+		if job, _ := jobs.Get(id); job.State == state {
+			return job, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	job, _ := jobs.Get(id)
+	return job, fmt.Errorf("job %s expected to be %s, found: %+v", id, state, job)
+}
+
+func TestReloadJobsCoalesce(t *testing.T) {
+	haproxy := &blockingHaproxy{started: make(chan struct{}), release: make(chan error)}
+	jobs := NewReloadJobs(NewReloader(haproxy, nil, &fakeValidator{}, nil, nil), reloadJobsHistory)
+
+	first := jobs.Submit(true)
+	<-haproxy.started
+	if _, err := waitForJob(jobs, first, JobRunning); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests received while a reload is running are served by the next one
+	second := jobs.Submit(false)
+	third := jobs.Submit(true)
+	if job, _ := jobs.Get(second); job.State != JobQueued {
+		t.Fatalf("job should be queued, found: %+v", job)
+	}
+
+	haproxy.release <- nil
+	<-haproxy.started
+	haproxy.release <- fmt.Errorf("reload failed")
+
+	job, _ := jobs.Wait(first)
+	if job.State != JobSucceeded || job.ServedBy != first || job.ConfigHash == "" {
+		t.Fatalf("first job should succeed, found: %+v", job)
+	}
+	var results []*ReloadResult
+	for _, id := range []string{second, third} {
+		job, _ := jobs.Wait(id)
+		if job.State != JobFailed || job.ServedBy != second || job.Result.Error != "reload failed" {
+			t.Fatalf("job %s should fail in coalesced reload, found: %+v", id, job)
+		}
+		results = append(results, job.Result)
+	}
+	if results[0] == results[1] {
+		t.Fatal("coalesced jobs shouldn't share their result")
+	}
+	if n := haproxy.Reloads(); n != 1 {
+		t.Fatalf("one successful reload expected, found %d", n)
+	}
+
+	if _, found := jobs.Get("unknown"); found {
+		t.Fatal("unknown job shouldn't be found")
+	}
+}
+
+func TestReloadJobsReload(t *testing.T) {
+	haproxy := &fakeHaproxy{}
+	jobs := NewReloadJobs(NewReloader(haproxy, nil, &fakeValidator{}, nil, nil), reloadJobsHistory)
+	job, err := jobs.Reload(true)
+	if err != nil || job.State != JobSucceeded {
+		t.Fatalf("reload expected to succeed, found: %+v (%v)", job, err)
+	}
+	if _, found := jobs.Get(job.ID); !found {
+		t.Fatal("reload expected to be registered as a job")
+	}
+}
+
+func TestReloadJobsHistory(t *testing.T) {
+	jobs := NewReloadJobs(NewReloader(&fakeHaproxy{}, nil, &fakeValidator{}, nil, nil), 2)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id := jobs.Submit(true)
+		jobs.Wait(id)
+		ids = append(ids, id)
+	}
+	if _, found := jobs.Get(ids[0]); found {
+		t.Fatal("oldest job should be forgotten")
+	}
+	if job, found := jobs.Get(ids[2]); !found || job.State != JobSucceeded {
+		t.Fatalf("last job should be kept, found: %+v", job)
+	}
+
+	// Jobs not finished are kept beyond the history
+	haproxy := &blockingHaproxy{started: make(chan struct{}), release: make(chan error)}
+	jobs = NewReloadJobs(NewReloader(haproxy, nil, &fakeValidator{}, nil, nil), 2)
+	running := jobs.Submit(true)
+	<-haproxy.started
+	var queued []string
+	for i := 0; i < 3; i++ {
+		queued = append(queued, jobs.Submit(true))
+	}
+	for _, id := range append(queued, running) {
+		if _, found := jobs.Get(id); !found {
+			t.Fatalf("pending job %s should be kept", id)
+		}
+	}
+	haproxy.release <- nil
+	<-haproxy.started
+	haproxy.release <- nil
+	for _, id := range queued {
+		if job, found := jobs.Wait(id); !found || job.State != JobSucceeded {
+			t.Fatalf("queued job %s expected to succeed, found: %+v", id, job)
+		}
+	}
+}
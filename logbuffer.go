@@ -0,0 +1,310 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogSourceSyslog  = "syslog"
+	LogSourceHaproxy = "haproxy"
+)
+
+// Subscribers not reading fast enough lose entries instead of blocking
+// log producers.
+const logSubscriberBufferSize = 256
+
+const defaultLogLines = 100
+
+type LogEntry struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Tag      string    `json:"tag,omitempty"`
+	Severity int       `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+// LogEntryFilter selects log entries, empty Source and Contains match
+// everything. MinSeverity is the least important severity kept, as in syslog
+// severities, so 0 only keeps emergency entries and 7 keeps all of them.
+type LogEntryFilter struct {
+	Source      string
+	MinSeverity int
+	Contains    string
+}
+
+func (f LogEntryFilter) Match(e LogEntry) bool {
+	if len(f.Source) > 0 && e.Source != f.Source {
+		return false
+	}
+	if e.Severity > f.MinSeverity {
+		return false
+	}
+	return strings.Contains(e.Message, f.Contains)
+}
+
+// LogBuffer keeps the last log entries in memory.
+type LogBuffer struct {
+	sync.Mutex
+
+	entries []LogEntry
+	next    int
+	full    bool
+
+	subscribers map[chan LogEntry]struct{}
+}
+
+func NewLogBuffer(size int) (*LogBuffer, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("log buffer size must be at least 1, found %d", size)
+	}
+	return &LogBuffer{
+		entries:     make([]LogEntry, size),
+		subscribers: make(map[chan LogEntry]struct{}),
+	}, nil
+}
+
+// Add stores an entry in the buffer, overwriting the oldest one if full.
+func (b *LogBuffer) Add(e LogEntry) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for s := range b.subscribers {
+		select {
+		case s <- e:
+		default:
+		}
+	}
+}
+
+// Last returns up to the last n entries matching the filter, oldest first.
+func (b *LogBuffer) Last(n int, filter LogEntryFilter) []LogEntry {
+	b.Lock()
+	defer b.Unlock()
+	return b.last(n, filter)
+}
+
+func (b *LogBuffer) last(n int, filter LogEntryFilter) []LogEntry {
+	size := b.next
+	if b.full {
+		size = len(b.entries)
+	}
+	var entries []LogEntry
+	for i := 1; i <= size && len(entries) < n; i++ {
+		e := b.entries[(b.next-i+len(b.entries))%len(b.entries)]
+		if filter.Match(e) {
+			entries = append(entries, e)
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// Subscribe returns a channel where new entries are sent, and a function to
+// cancel the subscription.
+func (b *LogBuffer) Subscribe() (<-chan LogEntry, func()) {
+	b.Lock()
+	defer b.Unlock()
+	return b.subscribe()
+}
+
+// Follow returns up to the last n entries matching the filter, and subscribes
+// to the new ones, so no entry is missed or received twice.
+func (b *LogBuffer) Follow(n int, filter LogEntryFilter) ([]LogEntry, <-chan LogEntry, func()) {
+	b.Lock()
+	defer b.Unlock()
+	entries, cancel := b.subscribe()
+	return b.last(n, filter), entries, cancel
+}
+
+func (b *LogBuffer) subscribe() (<-chan LogEntry, func()) {
+	s := make(chan LogEntry, logSubscriberBufferSize)
+	b.subscribers[s] = struct{}{}
+	return s, func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subscribers, s)
+	}
+}
+
+// Writer returns a writer that adds every line written to it as an entry of
+// the given source.
+func (b *LogBuffer) Writer(source string) io.Writer {
+	if b == nil {
+		return ioutil.Discard
+	}
+	return &logBufferWriter{buffer: b, source: source}
+}
+
+type logBufferWriter struct {
+	sync.Mutex
+
+	buffer *LogBuffer
+	source string
+	line   []byte
+}
+
+func (w *logBufferWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.line[:i])
+		w.line = w.line[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		w.buffer.Add(LogEntry{
+			Source:   w.source,
+			Severity: haproxyOutputSeverity(line),
+			Message:  line,
+		})
+	}
+	return len(p), nil
+}
+
+// haproxyOutputSeverity guesses the severity of a line written by haproxy to
+// its standard output.
+func haproxyOutputSeverity(line string) int {
+	switch {
+	case strings.HasPrefix(line, "[ALERT]"):
+		return 1
+	case strings.HasPrefix(line, "[WARNING]"):
+		return 4
+	case strings.HasPrefix(line, "[NOTICE]"):
+		return 5
+	}
+	return 6
+}
+
+func logRequestParams(req *http.Request, defaultLines int) (int, LogEntryFilter, error) {
+	query := req.URL.Query()
+	filter := LogEntryFilter{
+		Source:      query.Get("source"),
+		MinSeverity: len(syslogSeverities) - 1,
+		Contains:    query.Get("contains"),
+	}
+	n := defaultLines
+	if v := query.Get("n"); len(v) > 0 {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			return 0, filter, fmt.Errorf("incorrect number of lines: %s", v)
+		}
+	}
+	if v := query.Get("severity"); len(v) > 0 {
+		var err error
+		if filter.MinSeverity, err = parseSyslogSeverity(v); err != nil {
+			return 0, filter, err
+		}
+	}
+	return n, filter, nil
+}
+
+// ServeLast replies with the last entries in the buffer.
+func (b *LogBuffer) ServeLast(w http.ResponseWriter, req *http.Request) {
+	n, filter, err := logRequestParams(req, defaultLogLines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := b.Last(n, filter)
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// ServeFollow streams new entries as server-sent events, starting with the
+// last ones in the buffer.
+func (b *LogBuffer) ServeFollow(w http.ResponseWriter, req *http.Request) {
+	n, filter, err := logRequestParams(req, 10)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	last, entries, cancel := b.Follow(n, filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	send := func(e LogEntry) error {
+		d, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", d)
+		return err
+	}
+
+	for _, e := range last {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-entries:
+			if !filter.Match(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogBufferLast(t *testing.T) {
+	b, _ := NewLogBuffer(5)
+	for i := 0; i < 8; i++ {
+		b.Add(LogEntry{Source: LogSourceSyslog, Severity: 6, Message: fmt.Sprintf("message %d", i)})
+	}
+	all := LogEntryFilter{MinSeverity: 7}
+
+	entries := b.Last(10, all)
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries, found %d", len(entries))
+	}
+	if entries[0].Message != "message 3" || entries[4].Message != "message 7" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	entries = b.Last(2, all)
+	if len(entries) != 2 || entries[0].Message != "message 6" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	entries = b.Last(10, LogEntryFilter{MinSeverity: 7, Contains: "5"})
+	if len(entries) != 1 || entries[0].Message != "message 5" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	if entries := b.Last(10, LogEntryFilter{MinSeverity: 5}); len(entries) != 0 {
+		t.Fatalf("no entry expected, found %+v", entries)
+	}
+	if _, err := NewLogBuffer(0); err == nil {
+		t.Fatal("error expected with an empty buffer")
+	}
+}
+
+func TestLogBufferWriter(t *testing.T) {
+	b, _ := NewLogBuffer(10)
+	w := b.Writer(LogSourceHaproxy)
+	fmt.Fprint(w, "[WARNING] 001/000000 (1) : some warning\n[ALE")
+	fmt.Fprint(w, "RT] 001/000000 (1) : some alert\nincomplete")
+
+	entries := b.Last(10, LogEntryFilter{Source: LogSourceHaproxy, MinSeverity: 7})
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, found %+v", entries)
+	}
+	if entries[0].Severity != 4 || entries[1].Severity != 1 {
+		t.Fatalf("unexpected severities: %+v", entries)
+	}
+}
+
+func TestLogBufferServeLast(t *testing.T) {
+	b, _ := NewLogBuffer(10)
+	b.Add(LogEntry{Source: LogSourceSyslog, Severity: 6, Message: "from syslog"})
+	b.Add(LogEntry{Source: LogSourceHaproxy, Severity: 6, Message: "from haproxy"})
+
+	w := httptest.NewRecorder()
+	b.ServeLast(w, httptest.NewRequest("GET", "/logs?n=5&source=haproxy", nil))
+
+	var entries []LogEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Message != "from haproxy" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	w = httptest.NewRecorder()
+	b.ServeLast(w, httptest.NewRequest("GET", "/logs?n=foo", nil))
+	if w.Code != 400 {
+		t.Fatalf("expected bad request, found %d", w.Code)
+	}
+}
+
+func TestLogBufferSubscribe(t *testing.T) {
+	b, _ := NewLogBuffer(10)
+	entries, cancel := b.Subscribe()
+	defer cancel()
+
+	b.Add(LogEntry{Message: "new"})
+	select {
+	case e := <-entries:
+		if e.Message != "new" {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for entry")
+	}
+}
+
+func TestLogBufferFollow(t *testing.T) {
+	b, _ := NewLogBuffer(10)
+	b.Add(LogEntry{Message: "old"})
+	last, entries, cancel := b.Follow(10, LogEntryFilter{MinSeverity: 7})
+	defer cancel()
+	b.Add(LogEntry{Message: "new"})
+
+	if len(last) != 1 || last[0].Message != "old" {
+		t.Fatalf("only the old entry expected, found: %+v", last)
+	}
+	select {
+	case e := <-entries:
+		if e.Message != "new" {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for entry")
+	}
+}
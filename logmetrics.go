@@ -0,0 +1,321 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Label used for series beyond the cardinality limit
+const otherSeriesLabel = "other"
+
+// Buckets in seconds for latency histograms
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// AccessLog contains the fields of an haproxy access log line used for
+// metrics, both in HTTP and TCP default formats.
+type AccessLog struct {
+	Frontend string
+	Backend  string
+	Server   string
+
+	HTTP             bool
+	StatusCode       int
+	TerminationState string
+
+	// Timers are negative when not available
+	ResponseTime time.Duration
+	TotalTime    time.Duration
+}
+
+func parseTimer(s string) time.Duration {
+	s = strings.TrimPrefix(s, "+")
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		return -1
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// ParseAccessLog parses an access log line as generated by haproxy with
+// `option httplog` or `option tcplog`.
+func ParseAccessLog(line string) (*AccessLog, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("not enough fields")
+	}
+	if !strings.HasPrefix(fields[1], "[") || !strings.HasSuffix(fields[1], "]") {
+		return nil, fmt.Errorf("date expected, found: %s", fields[1])
+	}
+
+	l := AccessLog{Frontend: strings.TrimSuffix(fields[2], "~")}
+
+	backendServer := strings.SplitN(fields[3], "/", 2)
+	if len(backendServer) != 2 {
+		return nil, fmt.Errorf("backend/server expected, found: %s", fields[3])
+	}
+	l.Backend, l.Server = backendServer[0], backendServer[1]
+
+	timers := strings.Split(fields[4], "/")
+	switch len(timers) {
+	case 5:
+		// TR/Tw/Tc/Tr/Ta
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("not enough fields for HTTP log")
+		}
+		l.HTTP = true
+		l.ResponseTime = parseTimer(timers[3])
+		l.TotalTime = parseTimer(timers[4])
+		status, err := strconv.Atoi(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("status code expected, found: %s", fields[5])
+		}
+		l.StatusCode = status
+		l.TerminationState = fields[9]
+	case 3:
+		// Tw/Tc/Tt
+		l.ResponseTime = -1
+		l.TotalTime = parseTimer(timers[2])
+		l.TerminationState = fields[6]
+	default:
+		return nil, fmt.Errorf("timers expected, found: %s", fields[4])
+	}
+	if len(l.TerminationState) < 2 {
+		return nil, fmt.Errorf("termination state expected, found: %s", l.TerminationState)
+	}
+	return &l, nil
+}
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return otherSeriesLabel
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type accessLogKey struct {
+	frontend, backend string
+}
+
+type accessLogSeries struct {
+	httpRequests   map[string]uint64
+	tcpConnections uint64
+	terminations   map[string]uint64
+	responseTime   histogram
+	totalTime      histogram
+}
+
+// AccessLogMetrics aggregates metrics from haproxy access logs. The number
+// of frontend/backend pairs is limited to maxSeries, the rest are aggregated
+// in a series labeled as "other".
+type AccessLogMetrics struct {
+	sync.Mutex
+
+	maxSeries int
+	series    map[accessLogKey]*accessLogSeries
+	unparsed  uint64
+}
+
+func NewAccessLogMetrics(maxSeries int) *AccessLogMetrics {
+	return &AccessLogMetrics{
+		maxSeries: maxSeries,
+		series:    make(map[accessLogKey]*accessLogSeries),
+	}
+}
+
+func (m *AccessLogMetrics) getSeries(key accessLogKey) *accessLogSeries {
+	if s, found := m.series[key]; found {
+		return s
+	}
+	if len(m.series) >= m.maxSeries {
+		key = accessLogKey{otherSeriesLabel, otherSeriesLabel}
+		if s, found := m.series[key]; found {
+			return s
+		}
+	}
+	s := &accessLogSeries{
+		httpRequests: make(map[string]uint64),
+		terminations: make(map[string]uint64),
+	}
+	m.series[key] = s
+	return s
+}
+
+// Observe updates metrics with a log message, messages that are not access
+// logs are only counted.
+func (m *AccessLogMetrics) Observe(message string) {
+	if m == nil {
+		return
+	}
+	l, err := ParseAccessLog(message)
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err != nil {
+		m.unparsed++
+		return
+	}
+	s := m.getSeries(accessLogKey{l.Frontend, l.Backend})
+	if l.HTTP {
+		s.httpRequests[statusClass(l.StatusCode)]++
+	} else {
+		s.tcpConnections++
+	}
+	s.terminations[l.TerminationState[:2]]++
+	s.responseTime.Observe(l.ResponseTime)
+	s.totalTime.Observe(l.TotalTime)
+}
+
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func (k accessLogKey) labels() string {
+	return fmt.Sprintf(`frontend="%s",backend="%s"`, escapeLabel(k.frontend), escapeLabel(k.backend))
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHistogram(w io.Writer, name, labels string, h histogram) {
+	if h.count == 0 {
+		return
+	}
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// WriteTo writes the metrics in Prometheus text format.
+func (m *AccessLogMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	keys := make([]accessLogKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].frontend != keys[j].frontend {
+			return keys[i].frontend < keys[j].frontend
+		}
+		return keys[i].backend < keys[j].backend
+	})
+
+	counter := &countingWriter{w: w}
+	b := bufio.NewWriter(counter)
+
+	fmt.Fprintln(b, "# HELP haproxy_log_http_requests_total HTTP requests found in access logs.")
+	fmt.Fprintln(b, "# TYPE haproxy_log_http_requests_total counter")
+	for _, k := range keys {
+		for _, code := range sortedKeys(m.series[k].httpRequests) {
+			fmt.Fprintf(b, "haproxy_log_http_requests_total{%s,code=\"%s\"} %d\n", k.labels(), code, m.series[k].httpRequests[code])
+		}
+	}
+
+	fmt.Fprintln(b, "# HELP haproxy_log_tcp_connections_total TCP connections found in access logs.")
+	fmt.Fprintln(b, "# TYPE haproxy_log_tcp_connections_total counter")
+	for _, k := range keys {
+		if n := m.series[k].tcpConnections; n > 0 {
+			fmt.Fprintf(b, "haproxy_log_tcp_connections_total{%s} %d\n", k.labels(), n)
+		}
+	}
+
+	fmt.Fprintln(b, "# HELP haproxy_log_terminations_total Sessions by termination state found in access logs.")
+	fmt.Fprintln(b, "# TYPE haproxy_log_terminations_total counter")
+	for _, k := range keys {
+		for _, state := range sortedKeys(m.series[k].terminations) {
+			fmt.Fprintf(b, "haproxy_log_terminations_total{%s,state=\"%s\"} %d\n", k.labels(), escapeLabel(state), m.series[k].terminations[state])
+		}
+	}
+
+	fmt.Fprintln(b, "# HELP haproxy_log_response_time_seconds Time waiting for the server to send the response headers (Tr).")
+	fmt.Fprintln(b, "# TYPE haproxy_log_response_time_seconds histogram")
+	for _, k := range keys {
+		writeHistogram(b, "haproxy_log_response_time_seconds", k.labels(), m.series[k].responseTime)
+	}
+
+	fmt.Fprintln(b, "# HELP haproxy_log_total_time_seconds Total time of the request or session (Ta or Tt).")
+	fmt.Fprintln(b, "# TYPE haproxy_log_total_time_seconds histogram")
+	for _, k := range keys {
+		writeHistogram(b, "haproxy_log_total_time_seconds", k.labels(), m.series[k].totalTime)
+	}
+
+	fmt.Fprintln(b, "# HELP haproxy_log_unparsed_total Log messages that couldn't be parsed as access logs.")
+	fmt.Fprintln(b, "# TYPE haproxy_log_unparsed_total counter")
+	fmt.Fprintf(b, "haproxy_log_unparsed_total %d\n", m.unparsed)
+
+	err := b.Flush()
+	return counter.n, err
+}
+
+func (m *AccessLogMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
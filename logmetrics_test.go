@@ -0,0 +1,102 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+const httpAccessLog = `10.0.0.1:43211 [09/Feb/2018:10:00:00.123] http-in~ app/srv1 0/0/1/20/25 200 1234 - - ---- 1/1/0/0/0 0/0 "GET / HTTP/1.1"`
+const tcpAccessLog = `10.0.0.1:5432 [09/Feb/2018:10:00:00.123] db-in db/pg1 0/0/5007 212 cD 0/0/0/0/0 0/0`
+
+func TestParseAccessLog(t *testing.T) {
+	l, err := ParseAccessLog(httpAccessLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AccessLog{
+		Frontend:         "http-in",
+		Backend:          "app",
+		Server:           "srv1",
+		HTTP:             true,
+		StatusCode:       200,
+		TerminationState: "----",
+		ResponseTime:     20 * time.Millisecond,
+		TotalTime:        25 * time.Millisecond,
+	}
+	if *l != expected {
+		t.Fatalf("expected %+v, found %+v", expected, *l)
+	}
+
+	l, err = ParseAccessLog(tcpAccessLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = AccessLog{
+		Frontend:         "db-in",
+		Backend:          "db",
+		Server:           "pg1",
+		TerminationState: "cD",
+		ResponseTime:     -1,
+		TotalTime:        5007 * time.Millisecond,
+	}
+	if *l != expected {
+		t.Fatalf("expected %+v, found %+v", expected, *l)
+	}
+
+	for _, line := range []string{
+		"Proxy http-in started.",
+		"Server app/srv1 is DOWN, reason: Layer4 connection problem",
+	} {
+		if _, err := ParseAccessLog(line); err == nil {
+			t.Errorf("parsing should fail for: %s", line)
+		}
+	}
+}
+
+func TestAccessLogMetrics(t *testing.T) {
+	m := NewAccessLogMetrics(1)
+	m.Observe(httpAccessLog)
+	m.Observe(strings.Replace(httpAccessLog, " 200 ", " 503 ", 1))
+	m.Observe(tcpAccessLog)
+	m.Observe("Proxy http-in started.")
+
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, expected := range []string{
+		`haproxy_log_http_requests_total{frontend="http-in",backend="app",code="2xx"} 1`,
+		`haproxy_log_http_requests_total{frontend="http-in",backend="app",code="5xx"} 1`,
+		`haproxy_log_tcp_connections_total{frontend="other",backend="other"} 1`,
+		`haproxy_log_terminations_total{frontend="http-in",backend="app",state="--"} 2`,
+		`haproxy_log_terminations_total{frontend="other",backend="other",state="cD"} 1`,
+		`haproxy_log_response_time_seconds_bucket{frontend="http-in",backend="app",le="0.025"} 2`,
+		`haproxy_log_total_time_seconds_count{frontend="other",backend="other"} 1`,
+		`haproxy_log_unparsed_total 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected line not found: %s", expected)
+		}
+	}
+	if strings.Contains(out, `haproxy_log_response_time_seconds_count{frontend="other"`) {
+		t.Error("TCP logs shouldn't have response time")
+	}
+}
@@ -17,9 +17,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -41,17 +43,91 @@ func watchHaproxyStart(haproxy HaproxyServer) chan bool {
 	return started
 }
 
+// stringListFlag is a flag that can be specified multiple times
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
-	var haproxyPath, haproxyPIDFile, haproxyConfigFile, controlAddress, haproxyMode string
-	var syslogPort uint
-	var showVersion bool
-	flag.UintVar(&syslogPort, "syslog-port", 514, "Port for embedded syslog server")
+	// Subcommands control a running wrapper, without them the wrapper runs
+	if len(os.Args) > 1 {
+		if _, found := clientCommands[os.Args[1]]; found {
+			os.Exit(runClient(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	var haproxyPath, haproxyPIDFile, haproxyConfigTemplate, haproxyMode string
+	var haproxyConfigFiles, controlAddresses stringListFlag
+	var syslogMinSeverity, syslogFacilities, syslogHostnames, syslogTags string
+	var syslogListen stringListFlag
+	var syslogQueuePolicy string
+	var syslogPort, syslogQueueSize, logBufferSize, logMetricsMaxSeries uint
+	var logMetrics bool
+	var watchConfig, strictValidation, showVersion bool
+	var watchPaths, configURL, validationScript, validationPolicy string
+	var controlTokenFile, controlTLSCert, controlTLSKey, controlTLSClientCA string
+	var webhookURLs stringListFlag
+	var webhookSecretFile string
+	var webhookQueueSize, webhookRetries uint
+	var readyAddress, readyStatsSocket, haproxyStatsSocket string
+	var wrapperConfigPath string
+	var readyReloadGrace, gracefulStopTimeout, hardStopAfter time.Duration
+	var maxHaproxyGenerations uint
+	var watchDebounce, configPollInterval time.Duration
+	flag.UintVar(&syslogPort, "syslog-port", 514, "Port for embedded syslog server in localhost, used if no listener is set with -syslog-listen")
+	flag.Var(&syslogListen, "syslog-listen", "Listener for embedded syslog server (udp://addr:port, tcp://addr:port or unix:///path, optionally followed by ?tag=<tag>), can be repeated")
+	flag.UintVar(&syslogQueueSize, "syslog-queue-size", 1024, "Number of syslog messages that can be queued waiting to be written")
+	flag.StringVar(&syslogQueuePolicy, "syslog-queue-policy", SyslogQueueDropOldest, "Policy to apply when the syslog queue is full (one of: block, drop-newest, drop-oldest)")
+	flag.StringVar(&syslogMinSeverity, "syslog-min-severity", "debug", "Minimum severity of syslog messages to be logged (one of: emerg, alert, crit, err, warning, notice, info, debug)")
+	flag.StringVar(&syslogFacilities, "syslog-facilities", "", "Comma-separated list of syslog facilities to log, prefix them with '!' to exclude them")
+	flag.StringVar(&syslogHostnames, "syslog-hostnames", "", "Comma-separated list of syslog hostnames to log, prefix them with '!' to exclude them")
+	flag.StringVar(&syslogTags, "syslog-tags", "", "Comma-separated list of syslog tags to log, prefix them with '!' to exclude them")
+	flag.UintVar(&logBufferSize, "log-buffer-size", 1000, "Number of log lines kept in memory to be queried from the controller, 0 to disable it")
+	flag.BoolVar(&logMetrics, "log-metrics", true, "Expose metrics in /metrics obtained from haproxy access logs")
+	flag.UintVar(&logMetricsMaxSeries, "log-metrics-max-series", 100, "Maximum number of frontend/backend pairs in access log metrics, the rest are aggregated as 'other'")
 	flag.StringVar(&haproxyPath, "haproxy", "/usr/local/sbin/haproxy", "Path to haproxy binary")
 	flag.StringVar(&haproxyPIDFile, "haproxy-pidfile", "/var/run/haproxy.pid", "Pidfile for haproxy")
-	flag.StringVar(&controlAddress, "control-address", "127.0.0.1:15000", "HTTP port for controller commands")
-	flag.StringVar(&haproxyConfigFile, "haproxy-config", "/usr/local/etc/haproxy/haproxy.cfg", "Path to configuration file for haproxy")
+	flag.Var(&controlAddresses, "control-address", "Address for controller commands (addr:port, tcp://addr:port or unix:///path, unix sockets optionally followed by ?mode=<mode>&group=<group>), can be repeated (default 127.0.0.1:15000)")
+	flag.Var(&haproxyConfigFiles, "haproxy-config", "Path to configuration file or directory for haproxy, can be repeated (default /usr/local/etc/haproxy/haproxy.cfg)")
+	flag.StringVar(&controlTokenFile, "control-token-file", "", "File with the bearer tokens accepted by the controller, one per line optionally preceded by an identity, it is read again when it changes")
+	flag.StringVar(&controlTLSCert, "control-tls-cert", "", "Certificate to serve the controller with TLS in TCP addresses")
+	flag.StringVar(&controlTLSKey, "control-tls-key", "", "Key of the certificate to serve the controller with TLS")
+	flag.StringVar(&controlTLSClientCA, "control-tls-client-ca", "", "CA to verify client certificates, if set clients of the controller are required to present a valid certificate, except in probe entry points")
+	flag.StringVar(&haproxyConfigTemplate, "haproxy-config-template", "", "Path to a template used to render the first configuration file before starting, reloading or validating haproxy")
+	flag.BoolVar(&strictValidation, "strict-validation", false, "Consider configurations with warnings as invalid")
+	flag.StringVar(&validationScript, "validation-script", "", "Script to validate configuration, it receives configuration files as arguments and must fail if configuration is invalid")
+	flag.StringVar(&validationPolicy, "validation-policy", "", "Comma-separated list of policy rules to check on validation, or 'all' (rules: backend-health-checks, no-tcp-on-port-80, defaults-timeouts, stats-socket-expose-fd)")
 	flag.StringVar(&haproxyMode, "haproxy-mode", "master-worker", "Mode haproxy is expected to be running (one of: daemon, master-worker)")
+	flag.BoolVar(&watchConfig, "watch-config", false, "Watch configuration files and reload haproxy when they change and are valid")
+	flag.StringVar(&watchPaths, "watch-paths", "", "Comma-separated list of additional files or directories to watch for changes")
+	flag.DurationVar(&watchDebounce, "watch-debounce", 2*time.Second, "Time to wait for more changes before reloading after a configuration change is detected")
+	flag.StringVar(&configURL, "config-url", "", "URL to periodically obtain haproxy configuration from, it is written to the first configuration file, or to the template if set")
+	flag.DurationVar(&configPollInterval, "config-poll-interval", 30*time.Second, "Interval to poll the configuration URL")
+	flag.Var(&webhookURLs, "webhook-url", "URL notified with a JSON POST after every reload attempt and haproxy crash, can be repeated")
+	flag.StringVar(&webhookSecretFile, "webhook-secret-file", "", "File with a secret to sign webhook payloads with HMAC-SHA256")
+	flag.UintVar(&webhookQueueSize, "webhook-queue-size", 100, "Number of notifications that can be queued for each webhook")
+	flag.UintVar(&webhookRetries, "webhook-retries", 3, "Number of times a failed webhook notification is retried")
+	flag.StringVar(&readyAddress, "ready-address", "", "Address of a frontend that must accept TCP connections for haproxy to be ready")
+	flag.StringVar(&readyStatsSocket, "ready-stats-socket", "", "Path to haproxy stats socket that must answer for haproxy to be ready")
+	flag.DurationVar(&readyReloadGrace, "ready-reload-grace", 10*time.Second, "Time after a reload during which failing readiness checks are tolerated")
+	flag.DurationVar(&gracefulStopTimeout, "graceful-stop-timeout", 30*time.Second, "Time to wait for haproxy to finish current connections when stopping gracefully with SIGUSR1")
+	flag.DurationVar(&hardStopAfter, "hard-stop-after", 0, "Time after a reload to stop old haproxy processes still finishing their connections, 0 to wait for them indefinitely. Only in daemon mode, in master-worker mode use the hard-stop-after setting of haproxy")
+	flag.UintVar(&maxHaproxyGenerations, "max-haproxy-generations", 5, "Number of generations of haproxy processes alive at once above which a warning is logged, 0 to disable")
+	flag.StringVar(&haproxyStatsSocket, "haproxy-stats-socket", "", "Path to haproxy stats socket, commands are sent to it from /runtime")
+	flag.StringVar(&wrapperConfigPath, wrapperConfigFlag, "", "YAML or JSON file with settings of the wrapper, with the names of these flags, some of them can be changed without restarting")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		clientUsage(os.Stderr)
+	}
 	flag.Parse()
 
 	if showVersion {
@@ -59,17 +135,148 @@ func main() {
 		os.Exit(0)
 	}
 
-	syslog := NewSyslogServer(syslogPort)
+	wrapperConfig, err := NewWrapperConfig(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Incorrect wrapper configuration: %v\n", err)
+	}
+
+	// As PID 1 the wrapper inherits orphaned processes, as old haproxy
+	// processes in daemon mode, and it has to reap them
+	if os.Getpid() == 1 {
+		reaperDone := make(chan struct{})
+		defer close(reaperDone)
+		go reaper.Loop(reaperDone)
+	}
+
+	if len(haproxyConfigFiles) == 0 {
+		haproxyConfigFiles = append(haproxyConfigFiles, "/usr/local/etc/haproxy/haproxy.cfg")
+	}
+
+	syslogFilter, err := NewSyslogFilter(syslogMinSeverity, syslogFacilities, syslogHostnames, syslogTags)
+	if err != nil {
+		log.Fatalf("Incorrect syslog filter: %v\n", err)
+	}
+
+	var logs *LogBuffer
+	if logBufferSize > 0 {
+		logs, err = NewLogBuffer(int(logBufferSize))
+		if err != nil {
+			log.Fatalf("Incorrect log buffer: %v\n", err)
+		}
+	}
+
+	var metrics *AccessLogMetrics
+	if logMetrics {
+		metrics = NewAccessLogMetrics(int(logMetricsMaxSeries))
+	}
+
+	if len(syslogListen) == 0 {
+		syslogListen = append(syslogListen, fmt.Sprintf("udp://127.0.0.1:%d", syslogPort))
+	}
+	syslogListeners := make([]SyslogListener, len(syslogListen))
+	for i := range syslogListen {
+		syslogListeners[i], err = ParseSyslogListener(syslogListen[i])
+		if err != nil {
+			log.Fatalf("Incorrect syslog listener: %v\n", err)
+		}
+	}
+
+	if len(controlAddresses) == 0 {
+		controlAddresses = append(controlAddresses, "127.0.0.1:15000")
+	}
+	controlListeners := make([]ControlListener, len(controlAddresses))
+	for i := range controlAddresses {
+		controlListeners[i], err = ParseControlListener(controlAddresses[i])
+		if err != nil {
+			log.Fatalf("Incorrect control address: %v\n", err)
+		}
+	}
+
+	syslogQueue, err := NewSyslogQueue(int(syslogQueueSize), syslogQueuePolicy)
+	if err != nil {
+		log.Fatalf("Incorrect syslog queue: %v\n", err)
+	}
+
+	syslog := NewSyslogServer(syslogListeners, syslogQueue, syslogFilter, logs, metrics)
 	if err := syslog.Start(); err != nil {
 		log.Fatalf("Couldn't start embedded syslog: %v\n", err)
 	}
 	defer syslog.Stop()
 
-	haproxy, err := NewHaproxyServer(haproxyPath, haproxyPIDFile, haproxyConfigFile, haproxyMode)
+	events := NewEventBus()
+
+	haproxyOutput := io.MultiWriter(os.Stdout, logs.Writer(LogSourceHaproxy))
+	generations := NewHaproxyGenerations(hardStopAfter, int(maxHaproxyGenerations))
+	haproxy, err := NewHaproxyServer(haproxyPath, haproxyPIDFile, haproxyConfigFiles, haproxyMode, haproxyOutput, events, generations)
 	if err != nil {
 		log.Fatalf("Couldn't start haproxy manager: %v", err)
 	}
-	if err := haproxy.Start(); err != nil {
+	validators := ValidatorChain{NewHaproxyDashC(haproxyPath, haproxyConfigFiles, strictValidation)}
+	if len(validationScript) > 0 {
+		validators = append(validators, NewScriptValidator(validationScript, haproxyConfigFiles))
+	}
+	if len(validationPolicy) > 0 {
+		policy, err := NewPolicyValidator(haproxyConfigFiles, strings.Split(validationPolicy, ","))
+		if err != nil {
+			log.Fatalf("Incorrect validation policy: %v\n", err)
+		}
+		validators = append(validators, policy)
+	}
+	var validator HaproxyConfigValidator = validators
+
+	var template *ConfigTemplate
+	if len(haproxyConfigTemplate) > 0 {
+		template = NewConfigTemplate(haproxyConfigTemplate, haproxyConfigFiles[0])
+		haproxy = NewTemplatedHaproxyServer(haproxy, template)
+		validator = NewTemplatedValidator(validator, template)
+	}
+	validator = NewEventValidator(validator, events)
+
+	reloader := NewReloader(haproxy, haproxyConfigFiles, validator, template, events)
+	jobs := NewReloadJobs(reloader, reloadJobsHistory)
+	controller := NewController(controlListeners, jobs, validator)
+	if logs != nil {
+		controller.HandleFunc("/logs", logs.ServeLast)
+		controller.HandleFunc("/logs/follow", logs.ServeFollow)
+	}
+	if metrics != nil {
+		controller.HandleFunc("/metrics", metrics.ServeHTTP)
+	}
+	controller.HandleFunc("/events", events.ServeHTTP)
+	controller.HandleFunc("/readyz", NewReadiness(reloader, readyAddress, readyStatsSocket, readyReloadGrace).ServeHTTP)
+	controller.AddStatus("reload", reloader)
+	controller.AddStatus("haproxy_generations", generations)
+	if len(haproxyStatsSocket) > 0 {
+		controller.HandleFunc("/runtime", NewRuntimeAPI(haproxyStatsSocket, runtimeAPITimeout).ServeHTTP)
+	}
+	webhookSecret, err := readWebhookSecret(webhookSecretFile)
+	if err != nil {
+		log.Fatalf("Couldn't read webhook secret: %v\n", err)
+	}
+	notifier := NewWebhookNotifier(webhookURLs, webhookSecret, int(webhookQueueSize), int(webhookRetries), time.Second)
+	if err := notifier.Start(events); err != nil {
+		log.Fatalf("Couldn't start webhook notifications: %v\n", err)
+	}
+	defer notifier.Stop()
+	controller.AddStatus("webhooks", notifier)
+	controller.AddStatus("syslog", syslog)
+	var tokens *TokenFile
+	if len(controlTokenFile) > 0 {
+		tokens, err = NewTokenFile(controlTokenFile)
+		if err != nil {
+			log.Fatalf("Couldn't read control token file: %v\n", err)
+		}
+		controller.RequireToken(tokens)
+	}
+	if len(controlTLSCert) > 0 {
+		tlsConfig, err := NewControlTLSConfig(controlTLSCert, controlTLSKey, controlTLSClientCA)
+		if err != nil {
+			log.Fatalf("Incorrect controller TLS configuration: %v\n", err)
+		}
+		controller.UseTLS(tlsConfig)
+	}
+
+	if err := reloader.Start(); err != nil {
 		log.Println("Couldn't start haproxy: ", err)
 		log.Println("Will wait for valid configuration")
 		go func() {
@@ -82,17 +289,115 @@ func main() {
 	}
 	defer haproxy.Stop()
 
-	done := make(chan os.Signal)
-	signal.Notify(done, syscall.SIGTERM, syscall.SIGINT)
+	if len(configURL) > 0 {
+		target := haproxyConfigFiles[0]
+		if len(haproxyConfigTemplate) > 0 {
+			target = haproxyConfigTemplate
+		}
+		source := NewHTTPConfigSource(configURL, target, configPollInterval, jobs, validator, template)
+		if err := source.Start(); err != nil {
+			log.Fatalf("Couldn't start polling configuration: %v\n", err)
+		}
+		defer source.Stop()
+		controller.AddStatus("config_source", source)
+	}
+
+	// Settings that can be changed at runtime with a reload of the wrapper
+	// configuration
+	wrapperConfig.OnChange([]string{"syslog-min-severity", "syslog-facilities", "syslog-hostnames", "syslog-tags"}, func() error {
+		filter, err := NewSyslogFilter(syslogMinSeverity, syslogFacilities, syslogHostnames, syslogTags)
+		if err != nil {
+			return err
+		}
+		syslog.SetFilter(filter)
+		return nil
+	})
+	wrapperConfig.OnChange([]string{"webhook-url", "webhook-secret-file", "webhook-queue-size", "webhook-retries"}, func() error {
+		secret, err := readWebhookSecret(webhookSecretFile)
+		if err != nil {
+			return err
+		}
+		notifier.Reconfigure(webhookURLs, secret, int(webhookQueueSize), int(webhookRetries))
+		return nil
+	})
+	wrapperConfig.OnChange([]string{"control-token-file"}, func() error {
+		// Enabling or disabling authentication requires a restart
+		if tokens == nil || len(controlTokenFile) == 0 {
+			return fmt.Errorf("authentication can only be enabled or disabled with a restart")
+		}
+		return tokens.SetPath(controlTokenFile)
+	})
+	wrapperConfig.OnChange([]string{"net-queue-ips"}, func() error {
+		ips, err := ipArgs(netQueueIps)
+		if err != nil {
+			return err
+		}
+		configurer, ok := haproxy.(HaproxyNetQueueConfigurer)
+		if !ok {
+			return fmt.Errorf("connections are only retained during reloads in daemon mode")
+		}
+		return configurer.SetNetQueueIPs(ips)
+	})
+	controller.HandleFunc("/wrapper/reload", wrapperConfig.ServeHTTP)
+	controller.AddStatus("wrapper_config", wrapperConfig)
 
-	validator := NewHaproxyDashC(haproxyPath, haproxyConfigFile)
-	controller := NewController(controlAddress, haproxy, validator)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
+	if watchConfig {
+		paths := append([]string{}, haproxyConfigFiles...)
+		if len(haproxyConfigTemplate) > 0 {
+			paths = append(paths, haproxyConfigTemplate)
+		}
+		if len(watchPaths) > 0 {
+			paths = append(paths, strings.Split(watchPaths, ",")...)
+		}
+		watcher := NewConfigWatcher(paths, watchDebounce, jobs, validator)
+		if err := watcher.Start(); err != nil {
+			log.Fatalf("Couldn't watch configuration: %v\n", err)
+		}
+		defer watcher.Stop()
+	}
+
+	stop := func() {
+		if err := controller.Stop(); err != nil {
+			log.Fatalf("Couldn't cleanly stop controller: %v", err)
+		}
+	}
 	go func() {
-		for {
-			log.Printf("Signal received: %v\n", <-done)
-			if err := controller.Stop(); err != nil {
-				log.Fatalf("Couldn't cleanly stop controller: %v", err)
+		for s := range signals {
+			log.Printf("Signal received: %v\n", s)
+			switch s {
+			case syscall.SIGHUP:
+				// Reload wrapper settings and haproxy configuration,
+				// even if it hasn't changed
+				go func() {
+					if _, err := wrapperConfig.Reload(); err != nil {
+						log.Printf("Couldn't reload wrapper configuration: %v\n", err)
+					}
+					if _, err := jobs.Reload(true); err != nil {
+						log.Printf("Couldn't reload: %v\n", err)
+					}
+				}()
+			case syscall.SIGUSR1:
+				go func() {
+					log.Printf("Stopping gracefully, waiting up to %s for haproxy to finish current connections\n", gracefulStopTimeout)
+					if err := StopGracefully(haproxy, gracefulStopTimeout); err != nil {
+						log.Printf("Couldn't stop haproxy gracefully: %v\n", err)
+					}
+					stop()
+				}()
+			case syscall.SIGUSR2:
+				signaler, ok := haproxy.(HaproxySignaler)
+				if haproxyMode != "master-worker" || !ok {
+					log.Println("SIGUSR2 is only passed to haproxy in master-worker mode")
+					continue
+				}
+				if err := signaler.Signal(s); err != nil {
+					log.Printf("Couldn't pass signal to haproxy: %v\n", err)
+				}
+			default:
+				stop()
 			}
 		}
 	}()
@@ -42,8 +42,6 @@ const iptablesDeleteFlag = "-D"
 
 const procNetfilterQueuePath = "/proc/net/netfilter/nfnetlink_queue"
 
-var netQueue NetQueue
-
 func ipArgs(arg string) ([]net.IP, error) {
 	if len(arg) == 0 {
 		return nil, nil
@@ -65,6 +63,9 @@ type NetQueue interface {
 	Capture()
 	Release()
 	Stop()
+
+	// SetIPs replaces the IPs where connections are retained in next captures
+	SetIPs(ips []net.IP)
 }
 
 type dummyNetQueue struct{}
@@ -73,23 +74,31 @@ func (*dummyNetQueue) Capture() {}
 func (*dummyNetQueue) Release() {}
 func (*dummyNetQueue) Stop()    {}
 
+func (*dummyNetQueue) SetIPs(ips []net.IP) {}
+
 type netfilterQueue struct {
+	sync.Mutex
+
 	Number uint
 	IPs    []net.IP
 
+	events *EventBus
+
 	capture, capturing, release chan struct{}
 
 	cancel context.CancelFunc
 }
 
-// Factory method to obtain a netqueue depending on IP configuration
-func NewNetQueue(n uint, ips []net.IP) NetQueue {
+// Factory method to obtain a netqueue depending on IP configuration, capture
+// and release events are published in events
+func NewNetQueue(n uint, ips []net.IP, events *EventBus) NetQueue {
 	if len(ips) == 0 {
 		return &dummyNetQueue{}
 	}
 	q := netfilterQueue{
 		Number:    n,
 		IPs:       ips,
+		events:    events,
 		capture:   make(chan struct{}),
 		capturing: make(chan struct{}),
 		release:   make(chan struct{}),
@@ -106,8 +115,8 @@ func NewNetQueue(n uint, ips []net.IP) NetQueue {
 
 // Call to iptables to configure the rule to send packets
 // to the queue
-func (q *netfilterQueue) iptables(flag string) {
-	for _, ip := range q.IPs {
+func (q *netfilterQueue) iptables(flag string, ips []net.IP) {
+	for _, ip := range ips {
 		if ip.To4() == nil {
 			log.Printf("Only IPv4 addresses supported: %s found", ip.String())
 			continue
@@ -119,7 +128,7 @@ func (q *netfilterQueue) iptables(flag string) {
 			"--queue-num", strconv.Itoa(int(q.Number)),
 		}
 
-		err := exec.Command("iptables", args...).Run()
+		err := reaper.Run(exec.Command("iptables", args...))
 		if err != nil {
 			panic(fmt.Sprintf("iptables failed: %v", err))
 		}
@@ -165,8 +174,14 @@ func (q *netfilterQueue) loop(queue *nfqueue.NFQueue, ctx context.Context) {
 			return
 		}
 		func() {
-			q.iptables(iptablesAddFlag)
-			defer q.iptables(iptablesDeleteFlag)
+			// Rules are deleted for the same IPs they were added for,
+			// even if they are replaced while capturing
+			q.Lock()
+			ips := q.IPs
+			q.Unlock()
+			q.iptables(iptablesAddFlag, ips)
+			defer q.iptables(iptablesDeleteFlag, ips)
+			q.events.Publish(EventNetQueueCapture, map[string]interface{}{"queue": q.Number})
 			q.capturing <- struct{}{}
 			<-q.release
 		}()
@@ -206,18 +221,25 @@ func (q *netfilterQueue) loop(queue *nfqueue.NFQueue, ctx context.Context) {
 			log.Printf("Delayed %d packages during reloads\n", count)
 		}
 
+		var queueDropped, userDropped uint
 		if qData, found := procNf.Get(q.Number); found {
 			if qData.QueueDropped > lastQueueDropped {
-				log.Printf("Dropped %d packages due to full queue\n",
-					qData.QueueDropped-lastQueueDropped)
+				queueDropped = qData.QueueDropped - lastQueueDropped
+				log.Printf("Dropped %d packages due to full queue\n", queueDropped)
 				lastQueueDropped = qData.QueueDropped
 			}
 			if qData.UserDropped > lastUserDropped {
-				log.Printf("Dropped %d packages before reaching user space\n",
-					qData.UserDropped-lastUserDropped)
+				userDropped = qData.UserDropped - lastUserDropped
+				log.Printf("Dropped %d packages before reaching user space\n", userDropped)
 				lastUserDropped = qData.UserDropped
 			}
 		}
+		q.events.Publish(EventNetQueueRelease, map[string]interface{}{
+			"queue":         q.Number,
+			"delayed":       count,
+			"queue_dropped": queueDropped,
+			"user_dropped":  userDropped,
+		})
 	}
 }
 
@@ -230,6 +252,12 @@ func (q *netfilterQueue) Release() {
 	q.release <- struct{}{}
 }
 
+func (q *netfilterQueue) SetIPs(ips []net.IP) {
+	q.Lock()
+	defer q.Unlock()
+	q.IPs = ips
+}
+
 // Canceling the context will finish loop() and close
 // all queues and channels, after calling this method
 // this object shouldn't be used anymore
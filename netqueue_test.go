@@ -115,7 +115,7 @@ func TestNetfilterQueue(t *testing.T) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP}, nil)
 	defer nfQueue.Stop()
 
 	port := 80
@@ -170,7 +170,7 @@ func TestNetfilterQueue(t *testing.T) {
 
 func TestNetfilterQueueNoIPs(t *testing.T) {
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, nil)
+	nfQueue := NewNetQueue(queueId, nil, nil)
 	defer nfQueue.Stop()
 
 	pn, err := ReadProcNetfilter()
@@ -195,7 +195,7 @@ func TestNetfilterQueueExists(t *testing.T) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP}, nil)
 	defer nfQueue.Stop()
 
 	pn, err := ReadProcNetfilter()
@@ -220,7 +220,7 @@ func TestNetfilterQueueStop(t *testing.T) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP}, nil)
 
 	pn, err := ReadProcNetfilter()
 	if err != nil {
@@ -257,7 +257,7 @@ func BenchmarkProcNetfilterUpdateAndRead(b *testing.B) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP}, nil)
 	defer nfQueue.Stop()
 
 	pn, err := ReadProcNetfilter()
@@ -286,7 +286,7 @@ func BenchmarkNetfilterQueueCaptureReleaseOverload(b *testing.B) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP}, nil)
 	defer nfQueue.Stop()
 
 	// TODO: Send packets during the capture
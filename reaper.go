@@ -0,0 +1,234 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Interval to look for zombies even if no SIGCHLD is received, signals can
+// be coalesced
+const reaperInterval = 30 * time.Second
+
+// ProcessReaper reaps orphaned processes re-parented to the wrapper when it
+// runs as PID 1, as old haproxy processes in daemon mode. Processes waited by
+// the wrapper itself are registered so the reaper doesn't steal their exit
+// status, they are started and reaped under the same lock, so a process
+// cannot be reaped between its start and its registration.
+type ProcessReaper struct {
+	sync.Mutex
+
+	pid    int
+	waited map[int]int
+}
+
+// Processes started by the wrapper are started and waited through this reaper
+var reaper = NewProcessReaper()
+
+func NewProcessReaper() *ProcessReaper {
+	return &ProcessReaper{
+		pid:    os.Getpid(),
+		waited: make(map[int]int),
+	}
+}
+
+// Start starts a command that is going to be waited with Wait
+func (r *ProcessReaper) Start(cmd *exec.Cmd) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	r.waited[cmd.Process.Pid]++
+	return nil
+}
+
+// Wait waits for a command started with Start
+func (r *ProcessReaper) Wait(cmd *exec.Cmd) error {
+	defer r.Release(cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+func (r *ProcessReaper) Run(cmd *exec.Cmd) error {
+	if err := r.Start(cmd); err != nil {
+		return err
+	}
+	return r.Wait(cmd)
+}
+
+func (r *ProcessReaper) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := r.Run(cmd)
+	return out.Bytes(), err
+}
+
+// Hold prevents a process not started with Start from being reaped, so it can
+// be waited by other means, until it is released.
+func (r *ProcessReaper) Hold(pid int) {
+	r.Lock()
+	defer r.Unlock()
+	r.waited[pid]++
+}
+
+func (r *ProcessReaper) Release(pid int) {
+	r.Lock()
+	defer r.Unlock()
+	r.waited[pid]--
+	if r.waited[pid] <= 0 {
+		delete(r.waited, pid)
+	}
+}
+
+// Reap reaps the zombie children not waited by anyone else
+func (r *ProcessReaper) Reap() {
+	zombies, err := zombieChildren(r.pid)
+	if err != nil {
+		log.Printf("Couldn't look for zombie processes: %v\n", err)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, pid := range zombies {
+		if r.waited[pid] > 0 {
+			continue
+		}
+		var status syscall.WaitStatus
+		if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err != nil || reaped != pid {
+			continue
+		}
+		log.Printf("Reaped orphaned process %d, exit status %d\n", pid, status.ExitStatus())
+	}
+}
+
+// Loop reaps zombies when children finish, until done is closed
+func (r *ProcessReaper) Loop(done chan struct{}) {
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+	defer signal.Stop(children)
+
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-children:
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		r.Reap()
+	}
+}
+
+// zombieChildren returns the children of the given process that have finished
+// and haven't been waited yet.
+func zombieChildren(parent int) ([]int, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	var zombies []int
+	for _, path := range paths {
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			// Process already finished
+			continue
+		}
+		// Command name can contain spaces and parentheses, fields are
+		// after the last parenthesis
+		stat := string(d)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 2 || fields[0] != "Z" {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil || ppid != parent {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			continue
+		}
+		zombies = append(zombies, pid)
+	}
+	return zombies, nil
+}
+
+// Interval to check if a process that is not a child of the wrapper is alive
+const processPollInterval = time.Second
+
+// WaitProcess waits for a process to finish. Its exit status is only returned
+// for children of the wrapper, what old haproxy processes are when it runs as
+// PID 1, other processes are polled till they finish. Polled processes are
+// identified by their start time, so a reused pid is not waited.
+func (r *ProcessReaper) WaitProcess(pid int) *syscall.WaitStatus {
+	r.Hold(pid)
+	defer r.Release(pid)
+
+	started, err := processStartTime(pid)
+	if err != nil {
+		return nil
+	}
+
+	var status syscall.WaitStatus
+	for {
+		_, err := syscall.Wait4(pid, &status, 0, nil)
+		if err == nil {
+			return &status
+		}
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	for syscall.Kill(pid, 0) == nil {
+		if current, err := processStartTime(pid); err != nil || current != started {
+			break
+		}
+		time.Sleep(processPollInterval)
+	}
+	return nil
+}
+
+// processStartTime returns the time a process started, in clock ticks since
+// boot, as found in /proc/<pid>/stat
+func processStartTime(pid int) (uint64, error) {
+	d, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// Command name can contain spaces and parentheses, fields are after
+	// the last parenthesis, starting with the state, that is the third one
+	stat := string(d)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected format of stat of process %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,144 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func isZombie(pid int) bool {
+	zombies, _ := zombieChildren(os.Getpid())
+	for _, zombie := range zombies {
+		if zombie == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func waitForZombie(t *testing.T, pid int) {
+	for i := 0; i < 200; i++ {
+		if isZombie(pid) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process %d expected to be a zombie", pid)
+}
+
+func TestProcessReaper(t *testing.T) {
+	r := NewProcessReaper()
+
+	// Orphan-like process, nobody waits for it
+	orphan := exec.Command("true")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Process waited by the wrapper
+	waited := exec.Command("true")
+	if err := r.Start(waited); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForZombie(t, orphan.Process.Pid)
+	waitForZombie(t, waited.Process.Pid)
+	r.Reap()
+
+	if isZombie(orphan.Process.Pid) {
+		t.Fatal("orphan process expected to be reaped")
+	}
+	if !isZombie(waited.Process.Pid) {
+		t.Fatal("waited process shouldn't be reaped")
+	}
+	if err := r.Wait(waited); err != nil {
+		t.Fatalf("waited process expected to finish successfully, found %v", err)
+	}
+
+	held := exec.Command("true")
+	if err := held.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Hold(held.Process.Pid)
+	waitForZombie(t, held.Process.Pid)
+	r.Reap()
+	if !isZombie(held.Process.Pid) {
+		t.Fatal("held process shouldn't be reaped")
+	}
+	held.Wait()
+	r.Release(held.Process.Pid)
+}
+
+func TestWaitProcess(t *testing.T) {
+	child := exec.Command("sleep", "0.1")
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	status := NewProcessReaper().WaitProcess(child.Process.Pid)
+	if status == nil || status.ExitStatus() != 0 {
+		t.Fatalf("exit status of children expected, found %v", status)
+	}
+
+	if started, err := processStartTime(os.Getpid()); err != nil || started == 0 {
+		t.Fatalf("start time of the wrapper expected, found %d (%v)", started, err)
+	}
+	// Finished processes are not waited
+	if status := NewProcessReaper().WaitProcess(child.Process.Pid); status != nil {
+		t.Fatalf("no status expected for finished processes, found %v", status)
+	}
+}
+
+// fakeSignaledHaproxy stops on SIGUSR1 if graceful is set
+type fakeSignaledHaproxy struct {
+	fakeHaproxy
+	lock     sync.Mutex
+	graceful bool
+	signals  []os.Signal
+}
+
+func (h *fakeSignaledHaproxy) Signal(signal os.Signal) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.signals = append(h.signals, signal)
+	if signal == syscall.SIGUSR1 && h.graceful {
+		h.fakeHaproxy.Stop()
+	}
+	return nil
+}
+
+func TestStopGracefully(t *testing.T) {
+	haproxy := &fakeSignaledHaproxy{graceful: true}
+	haproxy.Start()
+	if err := StopGracefully(haproxy, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(haproxy.signals) != 1 || haproxy.signals[0] != syscall.SIGUSR1 {
+		t.Fatalf("SIGUSR1 expected, found %v", haproxy.signals)
+	}
+
+	haproxy = &fakeSignaledHaproxy{}
+	haproxy.Start()
+	if err := StopGracefully(haproxy, 200*time.Millisecond); err == nil {
+		t.Fatal("error expected if haproxy doesn't stop")
+	}
+
+	if err := StopGracefully(&fakeHaproxy{}, time.Second); err == nil {
+		t.Fatal("error expected if haproxy cannot be signaled")
+	}
+}
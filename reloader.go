@@ -0,0 +1,262 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReloadResult describes the outcome of a reload, or of what a reload would
+// do on dry runs.
+type ReloadResult struct {
+	Reloaded   bool               `json:"reloaded"`
+	Unchanged  bool               `json:"unchanged,omitempty"`
+	DryRun     bool               `json:"dry_run,omitempty"`
+	ConfigHash string             `json:"config_hash,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Diff       *ConfigDiff        `json:"diff,omitempty"`
+	Validation *ValidationResult  `json:"validation,omitempty"`
+	Sockets    []SocketCheck      `json:"sockets,omitempty"`
+	Plan       *HaproxyReloadPlan `json:"plan,omitempty"`
+}
+
+// ReloaderStatus is the state of the last reload
+type ReloaderStatus struct {
+	Reloading    bool      `json:"reloading"`
+	ConfigHash   string    `json:"config_hash,omitempty"`
+	LastReload   time.Time `json:"last_reload"`
+	LastFinished time.Time `json:"last_finished"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Reloader reloads haproxy keeping track of the configuration it is running,
+// so changes can be reported. All reloads are serialized.
+type Reloader struct {
+	sync.Mutex
+
+	haproxy     HaproxyServer
+	configFiles []string
+	validator   HaproxyConfigValidator
+	template    *ConfigTemplate
+	events      *EventBus
+
+	running     *HaproxyConfig
+	runningHash string
+
+	// Status has its own lock so it can be read during reloads
+	statusLock sync.Mutex
+	status     ReloaderStatus
+}
+
+// NewReloader returns a reloader for haproxy, template can be nil if
+// configuration is not rendered from a template. Results of reloads are
+// published in events.
+func NewReloader(haproxy HaproxyServer, configFiles []string, validator HaproxyConfigValidator, template *ConfigTemplate, events *EventBus) *Reloader {
+	return &Reloader{
+		haproxy:     haproxy,
+		configFiles: configFiles,
+		validator:   validator,
+		template:    template,
+		events:      events,
+	}
+}
+
+// Start starts haproxy and remembers the configuration it was started with
+func (r *Reloader) Start() error {
+	r.Lock()
+	defer r.Unlock()
+
+	hash, _ := r.hash()
+	r.setConfigHash(hash)
+	if err := r.haproxy.Start(); err != nil {
+		return err
+	}
+	r.running, _ = r.loaded()
+	r.runningHash = hash
+	r.setStatus(func(s *ReloaderStatus) { s.ConfigHash = hash })
+	return nil
+}
+
+// Reload reloads haproxy and returns the changes in the configuration since
+// the last successful reload. If the configuration, including the files it
+// references, hasn't changed, haproxy is not reloaded unless forced.
+func (r *Reloader) Reload(force bool) (ReloadResult, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	hash, err := r.hash()
+	if err != nil {
+		log.Printf("Couldn't calculate configuration hash: %v\n", err)
+	}
+	if !force && len(hash) > 0 && hash == r.runningHash && r.haproxy.IsRunning() {
+		log.Println("Configuration unchanged, not reloading")
+		r.events.Publish(EventReloadUnchanged, map[string]interface{}{"config_hash": hash})
+		return ReloadResult{Unchanged: true, ConfigHash: hash}, nil
+	}
+
+	r.setStatus(func(s *ReloaderStatus) {
+		s.Reloading = true
+		s.LastReload = time.Now()
+	})
+	r.setConfigHash(hash)
+	err = r.haproxy.Reload()
+	r.setStatus(func(s *ReloaderStatus) {
+		s.Reloading = false
+		s.LastFinished = time.Now()
+		s.LastError = ""
+		if err != nil {
+			s.LastError = err.Error()
+		} else {
+			s.ConfigHash = hash
+		}
+	})
+	if err != nil {
+		r.events.Publish(EventReloadFailed, map[string]interface{}{"config_hash": hash, "error": err.Error()})
+		return ReloadResult{ConfigHash: hash, Error: err.Error()}, err
+	}
+	r.events.Publish(EventReloadSucceeded, map[string]interface{}{"config_hash": hash})
+	r.runningHash = hash
+	result := ReloadResult{Reloaded: true, ConfigHash: hash}
+
+	// Configuration is read after reloading, as it can be rendered on
+	// reload from a template.
+	config, err := r.loaded()
+	if err != nil {
+		log.Printf("Couldn't read configuration to report changes: %v\n", err)
+		r.running = nil
+		return result, nil
+	}
+	result.Diff = DiffHaproxyConfig(r.running, config)
+	r.running = config
+	log.Printf("Reloaded configuration changes: %s\n", result.Diff)
+	return result, nil
+}
+
+// setConfigHash passes the hash of the configuration to haproxy, so its
+// processes are registered with the same hash reported by the reloader.
+func (r *Reloader) setConfigHash(hash string) {
+	if hasher, ok := r.haproxy.(HaproxyConfigHasher); ok {
+		hasher.SetConfigHash(hash)
+	}
+}
+
+func (r *Reloader) setStatus(update func(*ReloaderStatus)) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	update(&r.status)
+}
+
+// ReloadStatus returns the state of the last reload, it doesn't wait for
+// running reloads.
+func (r *Reloader) ReloadStatus() ReloaderStatus {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	return r.status
+}
+
+func (r *Reloader) Status() interface{} {
+	return r.ReloadStatus()
+}
+
+// DryRun goes through the steps of a reload without modifying configuration
+// files or signaling haproxy, and reports what the reload would do. Templates
+// are rendered in memory and validated as a replacement of the first
+// configuration file.
+func (r *Reloader) DryRun() (ReloadResult, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	result := ReloadResult{DryRun: true}
+	fail := func(err error) (ReloadResult, error) {
+		result.Error = err.Error()
+		return result, err
+	}
+
+	var rendered []byte
+	if r.template != nil {
+		var err error
+		rendered, err = r.template.Execute()
+		if err != nil {
+			result.Validation = &ValidationResult{Items: []ValidationItem{{
+				Severity: ValidationAlert,
+				File:     r.template.source,
+				Message:  err.Error(),
+			}}}
+			return fail(err)
+		}
+	}
+
+	validation, err := r.validate(rendered)
+	result.Validation = &validation
+	if err != nil {
+		return fail(fmt.Errorf("invalid configuration: %v", err))
+	}
+
+	config, err := ParseHaproxyConfigFiles(r.configFiles, rendered)
+	if err != nil {
+		return fail(err)
+	}
+	result.Diff = DiffHaproxyConfig(r.running, config)
+	if result.ConfigHash, err = effectiveConfigHash(r.configFiles, rendered); err == nil {
+		result.Unchanged = result.ConfigHash == r.runningHash && r.haproxy.IsRunning()
+	}
+	result.Sockets = CheckSockets(r.running, config, r.haproxy.IsRunning())
+
+	planner, ok := r.haproxy.(HaproxyReloadPlanner)
+	if !ok {
+		return fail(fmt.Errorf("haproxy server doesn't support planning reloads"))
+	}
+	if result.Plan, err = planner.PlanReload(); err != nil {
+		return fail(err)
+	}
+
+	for _, s := range result.Sockets {
+		if s.Status == SocketUnavailable {
+			return fail(fmt.Errorf("cannot listen on %s: %s", s.Address, s.Error))
+		}
+	}
+	return result, nil
+}
+
+func (r *Reloader) validate(rendered []byte) (ValidationResult, error) {
+	if rendered == nil {
+		return r.validator.Validate()
+	}
+	validator, ok := r.validator.(HaproxyContentValidator)
+	if !ok {
+		return ValidationResult{}, fmt.Errorf("validator doesn't support validating content")
+	}
+	return validator.ValidateContent(rendered)
+}
+
+// hash returns the hash of the effective configuration, rendering the
+// template in memory if needed.
+func (r *Reloader) hash() (string, error) {
+	var rendered []byte
+	if r.template != nil {
+		var err error
+		if rendered, err = r.template.Execute(); err != nil {
+			return "", err
+		}
+	}
+	return effectiveConfigHash(r.configFiles, rendered)
+}
+
+func (r *Reloader) loaded() (*HaproxyConfig, error) {
+	return ParseHaproxyConfigFiles(r.configFiles, nil)
+}
@@ -0,0 +1,249 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloaderDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(config, []byte(diffOldConfig), 0644)
+
+	haproxy := &fakeHaproxy{}
+	reloader := NewReloader(haproxy, []string{config}, &fakeValidator{}, nil, nil)
+	if err := reloader.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(config, []byte(diffNewConfig), 0644)
+	result, err := reloader.Reload(false)
+	if err != nil || !result.Reloaded {
+		t.Fatalf("reload expected, found: %+v (%v)", result, err)
+	}
+	if len(result.Diff.Added) != 1 || len(result.Diff.Removed) != 1 || len(result.Diff.Modified) != 2 {
+		t.Fatalf("unexpected changes: %s", result.Diff)
+	}
+
+	result, err = reloader.Reload(true)
+	if err != nil || !result.Reloaded || !result.Diff.Empty() {
+		t.Fatalf("no changes expected, found: %+v (%v)", result, err)
+	}
+}
+
+func TestReloaderUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "haproxy.cfg")
+	hosts := filepath.Join(dir, "hosts.map")
+	ioutil.WriteFile(config, []byte("frontend http\n  use_backend %[req.hdr(host),map("+hosts+")]\n"), 0644)
+	ioutil.WriteFile(hosts, []byte("example.com app\n"), 0644)
+
+	haproxy := &fakeHaproxy{}
+	reloader := NewReloader(haproxy, []string{config}, &fakeValidator{}, nil, nil)
+	if err := reloader.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := reloader.Reload(false)
+	if err != nil || result.Reloaded || !result.Unchanged || haproxy.Reloads() != 0 {
+		t.Fatalf("reload should be skipped, found: %+v (%v)", result, err)
+	}
+
+	result, err = reloader.Reload(true)
+	if err != nil || !result.Reloaded || haproxy.Reloads() != 1 {
+		t.Fatalf("forced reload expected, found: %+v (%v)", result, err)
+	}
+
+	ioutil.WriteFile(hosts, []byte("example.com other\n"), 0644)
+	result, err = reloader.Reload(false)
+	if err != nil || !result.Reloaded || haproxy.Reloads() != 2 {
+		t.Fatalf("reload expected after map change, found: %+v (%v)", result, err)
+	}
+}
+
+// fakeHashingHaproxy is a fake haproxy server that records the hashes of the
+// configurations it is started or reloaded with
+type fakeHashingHaproxy struct {
+	fakeHaproxy
+	hash string
+}
+
+func (h *fakeHashingHaproxy) SetConfigHash(hash string) {
+	h.Lock()
+	defer h.Unlock()
+	h.hash = hash
+}
+
+func TestReloaderConfigHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "haproxy.cfg.tmpl")
+	config := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(source, []byte(diffOldConfig), 0644)
+
+	template := NewConfigTemplate(source, config)
+	haproxy := &fakeHashingHaproxy{}
+	reloader := NewReloader(NewTemplatedHaproxyServer(haproxy, template), []string{config}, &fakeValidator{}, template, nil)
+	if err := reloader.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if hash := reloader.ReloadStatus().ConfigHash; hash == "" || haproxy.hash != hash {
+		t.Fatalf("haproxy expected to be started with hash %q, found %q", hash, haproxy.hash)
+	}
+
+	ioutil.WriteFile(source, []byte(diffNewConfig), 0644)
+	result, err := reloader.Reload(false)
+	if err != nil || !result.Reloaded {
+		t.Fatalf("reload expected, found: %+v (%v)", result, err)
+	}
+	if haproxy.hash != result.ConfigHash {
+		t.Fatalf("haproxy expected to be reloaded with hash %q, found %q", result.ConfigHash, haproxy.hash)
+	}
+}
+
+// fakePlanningHaproxy is a fake haproxy server that can plan reloads
+type fakePlanningHaproxy struct {
+	fakeHaproxy
+}
+
+func (h *fakePlanningHaproxy) PlanReload() (*HaproxyReloadPlan, error) {
+	return &HaproxyReloadPlan{Action: "reload", Pids: []int{42}}, nil
+}
+
+func TestReloaderDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "haproxy.cfg.tmpl")
+	config := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(source, []byte(diffOldConfig), 0644)
+	ioutil.WriteFile(config, []byte(diffOldConfig), 0644)
+
+	haproxy := &fakePlanningHaproxy{}
+	validator := &fakeContentValidator{}
+	reloader := NewReloader(haproxy, []string{config}, validator, NewConfigTemplate(source, config), nil)
+	if err := reloader.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	newConfig := strings.Replace(diffNewConfig, "bind :8080", "bind 127.0.0.1:0", 1)
+	ioutil.WriteFile(source, []byte(newConfig), 0644)
+	result, err := reloader.DryRun()
+	if err != nil {
+		t.Fatalf("dry run should succeed, found: %+v (%v)", result, err)
+	}
+	if result.Reloaded || !result.DryRun || haproxy.Reloads() != 0 {
+		t.Fatalf("haproxy shouldn't be reloaded, found: %+v", result)
+	}
+	if string(validator.content) != newConfig {
+		t.Fatalf("rendered configuration should be validated, found: %s", validator.content)
+	}
+	if d, _ := ioutil.ReadFile(config); string(d) != diffOldConfig {
+		t.Fatalf("configuration shouldn't be modified, found: %s", d)
+	}
+	if len(result.Diff.Added) != 1 || len(result.Diff.Removed) != 1 {
+		t.Fatalf("unexpected changes: %s", result.Diff)
+	}
+	if result.Plan == nil || len(result.Plan.Pids) != 1 || result.Plan.Pids[0] != 42 {
+		t.Fatalf("unexpected plan: %+v", result.Plan)
+	}
+	for _, s := range result.Sockets {
+		if s.Address == "127.0.0.1:0" && s.Status != SocketAvailable {
+			t.Fatalf("socket should be available: %+v", s)
+		}
+	}
+
+	ioutil.WriteFile(source, []byte("{{ .Missing }"), 0644)
+	if result, err := reloader.DryRun(); err == nil || result.Validation == nil || len(result.Validation.Items) != 1 {
+		t.Fatalf("dry run should fail on template errors, found: %+v", result)
+	}
+}
+
+func TestCheckSockets(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	busy := l.Addr().String()
+
+	running := parseTestConfig(t, "frontend http\n  bind :80\n")
+	new := parseTestConfig(t, "frontend http\n  bind :80\n  bind "+busy+",unix@/run/haproxy.sock\n")
+
+	checks := CheckSockets(running, new, true)
+	expected := []string{SocketHaproxy, SocketUnavailable, SocketUnchecked}
+	if len(checks) != len(expected) {
+		t.Fatalf("expected %d checks, found: %+v", len(expected), checks)
+	}
+	for i := range expected {
+		if checks[i].Status != expected[i] {
+			t.Fatalf("expected %s, found: %+v", expected[i], checks[i])
+		}
+	}
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:3A98 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:3A98 0100007F:D2F0 01 00000000:00000000 00:00000000 00000000     0        0 3 1 0000000000000000 20 4 30 10 -1
+`
+	listening, err := parseProcNetTCP(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listening) != 2 || listening[0].String() != "127.0.0.1:15000" || listening[1].String() != "0.0.0.0:80" {
+		t.Fatalf("unexpected listening sockets: %v", listening)
+	}
+
+	for addr, inUse := range map[string]bool{
+		"127.0.0.1:15000": true,
+		"127.0.0.2:15000": false,
+		":80":             true,
+		"10.0.0.1:80":     true,
+		"127.0.0.1:8080":  false,
+	} {
+		if _, found := findListening(listening, addr); found != inUse {
+			t.Errorf("%s expected in use: %v", addr, inUse)
+		}
+	}
+
+	if _, err := parseProcNetTCP("header\n 0: 0100007F 00000000:0000 0A\n"); err == nil {
+		t.Fatal("error expected with incorrect addresses")
+	}
+}
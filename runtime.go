@@ -0,0 +1,80 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const runtimeAPITimeout = 5 * time.Second
+
+// Maximum size of commands sent to the runtime API
+const maxRuntimeCommandSize = 64 << 10
+
+// RuntimeAPI sends commands to haproxy runtime API through its stats socket
+type RuntimeAPI struct {
+	socket  string
+	timeout time.Duration
+}
+
+func NewRuntimeAPI(socket string, timeout time.Duration) *RuntimeAPI {
+	return &RuntimeAPI{socket: socket, timeout: timeout}
+}
+
+// Execute sends a command and returns the response of haproxy
+func (a *RuntimeAPI) Execute(command string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", a.socket, a.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(a.timeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", strings.TrimSpace(command)); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(conn)
+}
+
+// ServeHTTP executes the command in the body of POST requests
+func (a *RuntimeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Commands must be sent in the body of POST requests\n", http.StatusMethodNotAllowed)
+		return
+	}
+	command, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRuntimeCommandSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read command: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(command))) == 0 {
+		http.Error(w, "Empty command\n", http.StatusBadRequest)
+		return
+	}
+	output, err := a.Execute(string(command))
+	if err != nil {
+		log.Printf("Runtime API command failed: %v\n", err)
+		http.Error(w, fmt.Sprintf("Command failed: %v\n", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(output)
+}
@@ -0,0 +1,217 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Tables of TCP sockets of the network namespace of the wrapper
+var procNetTCPFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// State of listening sockets in /proc/net/tcp
+const procNetTCPListen = "0A"
+
+// Status of listening sockets
+const (
+	SocketHaproxy     = "haproxy"
+	SocketAvailable   = "available"
+	SocketUnavailable = "unavailable"
+	SocketUnchecked   = "unchecked"
+)
+
+// SocketCheck is the result of checking if an address haproxy would listen
+// on can be used
+type SocketCheck struct {
+	Section string `json:"section"`
+	Address string `json:"address"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bindAddresses returns the addresses in bind lines of frontends, by section
+func bindAddresses(c *HaproxyConfig) []SocketCheck {
+	var addresses []SocketCheck
+	if c == nil {
+		return addresses
+	}
+	for _, section := range c.SectionsOf("frontend", "listen") {
+		for _, line := range section.Find("bind") {
+			if len(line.Fields) < 2 {
+				continue
+			}
+			for _, addr := range strings.Split(line.Fields[1], ",") {
+				addresses = append(addresses, SocketCheck{
+					Section: section.Type + " " + section.Name,
+					Address: addr,
+				})
+			}
+		}
+	}
+	return addresses
+}
+
+// tcpBindAddress returns the address to listen on for a bind address, or
+// false if it is not a TCP address that can be checked, as unix sockets or
+// port ranges.
+func tcpBindAddress(addr string) (string, bool) {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "ipv4@"), "ipv6@")
+	if strings.Contains(addr, "@") || strings.HasPrefix(addr, "/") {
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || strings.Contains(port, "-") {
+		return "", false
+	}
+	if host == "*" {
+		host = ""
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// CheckSockets checks if haproxy would be able to listen on the addresses
+// of the new configuration. Addresses already in the running configuration
+// are expected to be in use by haproxy, the rest should be available. Sockets
+// are not opened, listening ones are looked up in /proc, so checks don't
+// interfere with haproxy binding the same addresses.
+func CheckSockets(running, new *HaproxyConfig, haproxyRunning bool) []SocketCheck {
+	listening, listeningErr := listeningTCPSockets()
+
+	inUse := make(map[string]bool)
+	if haproxyRunning {
+		for _, s := range bindAddresses(running) {
+			inUse[s.Address] = true
+		}
+	}
+
+	checks := bindAddresses(new)
+	for i := range checks {
+		check := &checks[i]
+		if inUse[check.Address] {
+			check.Status = SocketHaproxy
+			continue
+		}
+		addr, ok := tcpBindAddress(check.Address)
+		if !ok {
+			check.Status = SocketUnchecked
+			continue
+		}
+		if listeningErr != nil {
+			check.Status = SocketUnchecked
+			check.Error = listeningErr.Error()
+			continue
+		}
+		if l, found := findListening(listening, addr); found {
+			check.Status = SocketUnavailable
+			check.Error = fmt.Sprintf("address in use by a socket listening on %s", l)
+			continue
+		}
+		check.Status = SocketAvailable
+	}
+	return checks
+}
+
+// findListening returns the listening socket that would conflict with
+// listening on addr
+func findListening(listening []*net.TCPAddr, addr string) (*net.TCPAddr, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port == 0 {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	if len(host) > 0 && ip == nil {
+		// Host names are resolved by haproxy
+		if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
+			ip = ips[0]
+		}
+	}
+	for _, l := range listening {
+		if l.Port != port {
+			continue
+		}
+		if ip == nil || ip.IsUnspecified() || l.IP.IsUnspecified() || l.IP.Equal(ip) {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// listeningTCPSockets returns the addresses of the listening TCP sockets
+func listeningTCPSockets() ([]*net.TCPAddr, error) {
+	var listening []*net.TCPAddr
+	for _, path := range procNetTCPFiles {
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read listening sockets: %v", err)
+		}
+		addrs, err := parseProcNetTCP(string(d))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse %s: %v", path, err)
+		}
+		listening = append(listening, addrs...)
+	}
+	return listening, nil
+}
+
+// parseProcNetTCP returns the local addresses of the listening sockets in a
+// table with the format of /proc/net/tcp
+func parseProcNetTCP(table string) ([]*net.TCPAddr, error) {
+	var listening []*net.TCPAddr
+	lines := strings.Split(table, "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != procNetTCPListen {
+			continue
+		}
+		addr, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		listening = append(listening, addr)
+	}
+	return listening, nil
+}
+
+// parseProcNetAddress parses addresses as 0100007F:0050, IP addresses are
+// written as 32 bits words in host byte order, that is assumed to be little
+// endian
+func parseProcNetAddress(s string) (*net.TCPAddr, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("incorrect address %q", s)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, fmt.Errorf("incorrect address %q", s)
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect port in %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -18,64 +18,237 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
 
 	"gopkg.in/mcuadros/go-syslog.v2"
 )
 
+// A SyslogListener is an address where the embedded syslog server receives
+// messages, messages received on it are tagged with Tag if set.
+type SyslogListener struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+// ParseSyslogListener parses listeners in the form udp://addr:port,
+// tcp://addr:port or unix:///path, optionally followed by ?tag=<tag>.
+func ParseSyslogListener(s string) (SyslogListener, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return SyslogListener{}, err
+	}
+	l := SyslogListener{Network: u.Scheme, Tag: u.Query().Get("tag")}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return l, fmt.Errorf("incorrect address in %s: %v", s, err)
+		}
+		l.Address = u.Host
+	case "unix":
+		if len(u.Path) == 0 {
+			return l, fmt.Errorf("path expected in %s", s)
+		}
+		l.Address = u.Path
+	default:
+		return l, fmt.Errorf("unknown syslog listener type in %s", s)
+	}
+	return l, nil
+}
+
+func (l SyslogListener) String() string {
+	return fmt.Sprintf("%s://%s", l.Network, l.Address)
+}
+
+func (l SyslogListener) listen(server *syslog.Server) error {
+	switch l.Network {
+	case "udp":
+		return server.ListenUDP(l.Address)
+	case "tcp":
+		return server.ListenTCP(l.Address)
+	case "unix":
+		if info, err := os.Stat(l.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Address)
+		}
+		return server.ListenUnixgram(l.Address)
+	}
+	return fmt.Errorf("unknown syslog listener type: %s", l.Network)
+}
+
+// taggedQueueHandler pushes log parts to a queue, tagging them with the
+// listener they were received on.
+type taggedQueueHandler struct {
+	tag   string
+	queue *SyslogQueue
+}
+
+func (h *taggedQueueHandler) Handle(logParts syslog.LogParts, messageLength int64, err error) {
+	if len(h.tag) > 0 {
+		logParts["listener_tag"] = h.tag
+	}
+	h.queue.Push(logParts)
+}
+
+// Interval to check if messages have been dropped
+const syslogDropsCheckInterval = 30 * time.Second
+
 type SyslogServer struct {
-	port   uint
-	server *syslog.Server
+	listeners  []SyslogListener
+	queue      *SyslogQueue
+	filterLock sync.RWMutex
+	filter     *SyslogFilter
+	logs       *LogBuffer
+	metrics    *AccessLogMetrics
+	servers    []*syslog.Server
+	done       chan struct{}
 }
 
-func NewSyslogServer(port uint) *SyslogServer {
-	return &SyslogServer{port: port}
+func NewSyslogServer(listeners []SyslogListener, queue *SyslogQueue, filter *SyslogFilter, logs *LogBuffer, metrics *AccessLogMetrics) *SyslogServer {
+	s := &SyslogServer{
+		listeners: listeners,
+		queue:     queue,
+		filter:    filter,
+		logs:      logs,
+		metrics:   metrics,
+	}
+	go s.loop()
+	return s
 }
 
-func (s *SyslogServer) Start() error {
-	if s.server != nil {
-		return fmt.Errorf("Server already started")
+func (s *SyslogServer) loop() {
+	for {
+		logParts := s.queue.Pop()
+		message := logPartsMessage(logParts)
+
+		// Metrics are collected also from filtered messages
+		s.metrics.Observe(message)
+
+		s.filterLock.RLock()
+		filter := s.filter
+		s.filterLock.RUnlock()
+		if !filter.Match(logParts) {
+			s.queue.Done(false)
+			continue
+		}
+
+		tag := logPartsString(logParts, "listener_tag")
+		if len(tag) > 0 {
+			log.Printf("[%s] %s", tag, message)
+		} else {
+			log.Println(message)
+		}
+		s.queue.Done(true)
+
+		severity, ok := logPartsInt(logParts, "severity")
+		if !ok {
+			severity = 6
+		}
+		s.logs.Add(LogEntry{
+			Source:   LogSourceSyslog,
+			Tag:      tag,
+			Severity: severity,
+			Message:  message,
+		})
 	}
+}
 
-	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
+// SetFilter replaces the filter applied to messages received from now on
+func (s *SyslogServer) SetFilter(filter *SyslogFilter) {
+	s.filterLock.Lock()
+	defer s.filterLock.Unlock()
+	s.filter = filter
+}
 
-	bindAddress := fmt.Sprintf("127.0.0.1:%d", s.port)
+// watchDrops periodically warns if messages have been dropped
+func (s *SyslogServer) watchDrops(done chan struct{}) {
+	ticker := time.NewTicker(syslogDropsCheckInterval)
+	defer ticker.Stop()
 
-	s.server = syslog.NewServer()
-	s.server.SetFormat(syslog.Automatic)
-	s.server.SetHandler(handler)
+	lastDropped := s.queue.Stats().Dropped
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		dropped := s.queue.Stats().Dropped
+		if dropped > lastDropped {
+			log.Printf("Dropped %d syslog messages in the last %s, output is not being read fast enough\n",
+				dropped-lastDropped, syslogDropsCheckInterval)
+			lastDropped = dropped
+		}
+	}
+}
 
-	if err := s.server.ListenUDP(bindAddress); err != nil {
-		return err
+// Status returns information about the server and its queue
+func (s *SyslogServer) Status() interface{} {
+	listeners := make([]string, len(s.listeners))
+	for i, l := range s.listeners {
+		listeners[i] = l.String()
 	}
-	if err := s.server.Boot(); err != nil {
-		return err
+	return struct {
+		Listeners []string         `json:"listeners"`
+		Queue     SyslogQueueStats `json:"queue"`
+	}{listeners, s.queue.Stats()}
+}
+
+func (s *SyslogServer) Start() error {
+	if s.servers != nil {
+		return fmt.Errorf("Server already started")
 	}
 
-	log.Printf("Syslog embedded server listening on %s", bindAddress)
-
-	go func(channel syslog.LogPartsChannel) {
-		for logParts := range channel {
-			if content, ok := logParts["content"]; ok {
-				log.Println(content)
-			} else if d, err := json.Marshal(logParts); err == nil {
-				log.Println(d)
-			} else {
-				log.Println(logParts)
-			}
+	for _, l := range s.listeners {
+		server := syslog.NewServer()
+		server.SetFormat(syslog.Automatic)
+		server.SetHandler(&taggedQueueHandler{tag: l.Tag, queue: s.queue})
+
+		if err := l.listen(server); err != nil {
+			s.Stop()
+			return err
 		}
-	}(channel)
+		if err := server.Boot(); err != nil {
+			s.Stop()
+			return err
+		}
+		s.servers = append(s.servers, server)
+
+		log.Printf("Syslog embedded server listening on %s", l)
+	}
+
+	s.done = make(chan struct{})
+	go s.watchDrops(s.done)
 
 	return nil
 }
 
+func logPartsMessage(logParts syslog.LogParts) string {
+	if content, ok := logParts["content"]; ok {
+		return fmt.Sprint(content)
+	} else if message, ok := logParts["message"]; ok {
+		return fmt.Sprint(message)
+	} else if d, err := json.Marshal(logParts); err == nil {
+		return string(d)
+	}
+	return fmt.Sprint(logParts)
+}
+
 func (s *SyslogServer) Stop() error {
-	if s.server == nil {
+	if s.servers == nil {
 		return fmt.Errorf("Server not started")
 	}
-	if err := s.server.Kill(); err != nil {
-		return fmt.Errorf("Couldn't kill server: %v", err)
+	for _, server := range s.servers {
+		if err := server.Kill(); err != nil {
+			return fmt.Errorf("Couldn't kill server: %v", err)
+		}
+	}
+	s.servers = nil
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
 	}
-	s.server = nil
 	return nil
 }
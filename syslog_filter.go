@@ -0,0 +1,192 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+func parseSyslogSeverity(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range syslogSeverities {
+		if s == name {
+			return i, nil
+		}
+	}
+	switch s {
+	case "error":
+		return 3, nil
+	case "warn":
+		return 4, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(syslogSeverities) {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown syslog severity: %s", s)
+}
+
+func parseSyslogFacility(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range syslogFacilities {
+		if s == name {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(syslogFacilities) {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility: %s", s)
+}
+
+// A syslogMatchList matches values against an include and an exclude list.
+// Empty include lists match everything not explicitly excluded.
+type syslogMatchList struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+// parseSyslogMatchList parses a comma-separated list of values, values
+// prefixed by '!' are excluded.
+func parseSyslogMatchList(arg string, normalize func(string) (string, error)) (syslogMatchList, error) {
+	l := syslogMatchList{}
+	if len(arg) == 0 {
+		return l, nil
+	}
+	for _, value := range strings.Split(arg, ",") {
+		value = strings.TrimSpace(value)
+		exclude := strings.HasPrefix(value, "!")
+		if exclude {
+			value = value[1:]
+		}
+		if len(value) == 0 {
+			continue
+		}
+		if normalize != nil {
+			var err error
+			if value, err = normalize(value); err != nil {
+				return l, err
+			}
+		}
+		if exclude {
+			if l.exclude == nil {
+				l.exclude = make(map[string]bool)
+			}
+			l.exclude[value] = true
+		} else {
+			if l.include == nil {
+				l.include = make(map[string]bool)
+			}
+			l.include[value] = true
+		}
+	}
+	return l, nil
+}
+
+func (l syslogMatchList) Match(value string) bool {
+	if l.exclude[value] {
+		return false
+	}
+	return len(l.include) == 0 || l.include[value]
+}
+
+// SyslogFilter decides which messages received by the embedded syslog server
+// are written to the output.
+type SyslogFilter struct {
+	// MinSeverity is the least important severity to be kept, as in syslog
+	// lower values are more important.
+	MinSeverity int
+
+	facilities syslogMatchList
+	hostnames  syslogMatchList
+	tags       syslogMatchList
+}
+
+// NewSyslogFilter builds a filter from its textual definition. Facilities,
+// hostnames and tags are comma-separated lists, values prefixed with '!' are
+// excluded, if there are other values, only these ones are included.
+func NewSyslogFilter(minSeverity, facilities, hostnames, tags string) (*SyslogFilter, error) {
+	f := SyslogFilter{MinSeverity: len(syslogSeverities) - 1}
+
+	var err error
+	if len(minSeverity) > 0 {
+		if f.MinSeverity, err = parseSyslogSeverity(minSeverity); err != nil {
+			return nil, err
+		}
+	}
+	f.facilities, err = parseSyslogMatchList(facilities, func(s string) (string, error) {
+		n, err := parseSyslogFacility(s)
+		return strconv.Itoa(n), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.hostnames, err = parseSyslogMatchList(hostnames, nil); err != nil {
+		return nil, err
+	}
+	if f.tags, err = parseSyslogMatchList(tags, nil); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func logPartsInt(logParts syslog.LogParts, key string) (int, bool) {
+	n, ok := logParts[key].(int)
+	return n, ok
+}
+
+func logPartsString(logParts syslog.LogParts, key string) string {
+	s, _ := logParts[key].(string)
+	return s
+}
+
+// logPartsTag returns the tag of a message, that is found in different
+// fields depending on the format of the message.
+func logPartsTag(logParts syslog.LogParts) string {
+	if tag := logPartsString(logParts, "tag"); len(tag) > 0 {
+		return tag
+	}
+	return logPartsString(logParts, "app_name")
+}
+
+// Match returns true if the message has to be kept.
+func (f *SyslogFilter) Match(logParts syslog.LogParts) bool {
+	if f == nil {
+		return true
+	}
+	if severity, ok := logPartsInt(logParts, "severity"); ok && severity > f.MinSeverity {
+		return false
+	}
+	if facility, ok := logPartsInt(logParts, "facility"); ok && !f.facilities.Match(strconv.Itoa(facility)) {
+		return false
+	}
+	if !f.hostnames.Match(logPartsString(logParts, "hostname")) {
+		return false
+	}
+	return f.tags.Match(logPartsTag(logParts))
+}
@@ -0,0 +1,63 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+func TestSyslogFilter(t *testing.T) {
+	cases := []struct {
+		minSeverity, facilities, hostnames, tags string
+		logParts                                 syslog.LogParts
+		expected                                 bool
+	}{
+		{"", "", "", "", syslog.LogParts{"severity": 7, "facility": 16}, true},
+		{"notice", "", "", "", syslog.LogParts{"severity": 6, "facility": 16}, false},
+		{"notice", "", "", "", syslog.LogParts{"severity": 5, "facility": 16}, true},
+		{"5", "", "", "", syslog.LogParts{"severity": 2, "facility": 16}, true},
+		{"", "local0", "", "", syslog.LogParts{"severity": 6, "facility": 16}, true},
+		{"", "local0", "", "", syslog.LogParts{"severity": 6, "facility": 17}, false},
+		{"", "!local1", "", "", syslog.LogParts{"severity": 6, "facility": 17}, false},
+		{"", "!local1", "", "", syslog.LogParts{"severity": 6, "facility": 16}, true},
+		{"", "", "lb1", "", syslog.LogParts{"hostname": "lb2"}, false},
+		{"", "", "!lb2", "", syslog.LogParts{"hostname": "lb1"}, true},
+		{"", "", "", "haproxy", syslog.LogParts{"tag": "haproxy"}, true},
+		{"", "", "", "haproxy", syslog.LogParts{"app_name": "haproxy"}, true},
+		{"", "", "", "!haproxy", syslog.LogParts{"tag": "haproxy"}, false},
+		{"", "", "", "haproxy", syslog.LogParts{"tag": "other"}, false},
+	}
+
+	for i, c := range cases {
+		f, err := NewSyslogFilter(c.minSeverity, c.facilities, c.hostnames, c.tags)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if m := f.Match(c.logParts); m != c.expected {
+			t.Errorf("case %d: expected %v, found %v", i, c.expected, m)
+		}
+	}
+}
+
+func TestSyslogFilterErrors(t *testing.T) {
+	if _, err := NewSyslogFilter("verbose", "", "", ""); err == nil {
+		t.Error("unknown severity should fail")
+	}
+	if _, err := NewSyslogFilter("", "local9", "", ""); err == nil {
+		t.Error("unknown facility should fail")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// Policies to apply when the syslog queue is full
+const (
+	SyslogQueueBlock      = "block"
+	SyslogQueueDropNewest = "drop-newest"
+	SyslogQueueDropOldest = "drop-oldest"
+)
+
+// SyslogQueueStats contains the counters of a syslog queue
+type SyslogQueueStats struct {
+	Policy   string `json:"policy"`
+	Size     int    `json:"size"`
+	Queued   int    `json:"queued"`
+	Received uint64 `json:"received"`
+	Filtered uint64 `json:"filtered"`
+	Written  uint64 `json:"written"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// SyslogQueue is a bounded queue that decouples the reception of syslog
+// messages from writing them.
+type SyslogQueue struct {
+	sync.Mutex
+	notEmpty, notFull *sync.Cond
+
+	items []syslog.LogParts
+	stats SyslogQueueStats
+}
+
+func NewSyslogQueue(size int, policy string) (*SyslogQueue, error) {
+	switch policy {
+	case SyslogQueueBlock, SyslogQueueDropNewest, SyslogQueueDropOldest:
+	default:
+		return nil, fmt.Errorf("unknown syslog queue policy: %s", policy)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("syslog queue size must be positive")
+	}
+	q := &SyslogQueue{
+		items: make([]syslog.LogParts, 0, size),
+		stats: SyslogQueueStats{Policy: policy, Size: size},
+	}
+	q.notEmpty = sync.NewCond(q)
+	q.notFull = sync.NewCond(q)
+	return q, nil
+}
+
+// Push adds a message to the queue, applying the policy if it is full.
+func (q *SyslogQueue) Push(logParts syslog.LogParts) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.stats.Received++
+	for len(q.items) >= q.stats.Size {
+		switch q.stats.Policy {
+		case SyslogQueueBlock:
+			q.notFull.Wait()
+			continue
+		case SyslogQueueDropNewest:
+			q.stats.Dropped++
+			return
+		case SyslogQueueDropOldest:
+			q.stats.Dropped++
+			q.items = q.items[1:]
+		}
+	}
+	q.items = append(q.items, logParts)
+	q.notEmpty.Signal()
+}
+
+// Pop returns the oldest message in the queue, waiting for it if empty.
+func (q *SyslogQueue) Pop() syslog.LogParts {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.items) == 0 {
+		q.notEmpty.Wait()
+	}
+	logParts := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.notFull.Signal()
+	return logParts
+}
+
+// Done accounts a popped message as written or filtered.
+func (q *SyslogQueue) Done(written bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if written {
+		q.stats.Written++
+	} else {
+		q.stats.Filtered++
+	}
+}
+
+func (q *SyslogQueue) Stats() SyslogQueueStats {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := q.stats
+	stats.Queued = len(q.items)
+	return stats
+}
@@ -0,0 +1,96 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+func pushMessages(q *SyslogQueue, n int) {
+	for i := 0; i < n; i++ {
+		q.Push(syslog.LogParts{"content": i})
+	}
+}
+
+func TestSyslogQueueDropNewest(t *testing.T) {
+	q, err := NewSyslogQueue(2, SyslogQueueDropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushMessages(q, 5)
+
+	if first := q.Pop()["content"]; first != 0 {
+		t.Fatalf("expected first message, found %v", first)
+	}
+	stats := q.Stats()
+	if stats.Received != 5 || stats.Dropped != 3 || stats.Queued != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSyslogQueueDropOldest(t *testing.T) {
+	q, err := NewSyslogQueue(2, SyslogQueueDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushMessages(q, 5)
+
+	if first := q.Pop()["content"]; first != 3 {
+		t.Fatalf("expected fourth message, found %v", first)
+	}
+	q.Done(true)
+	stats := q.Stats()
+	if stats.Received != 5 || stats.Dropped != 3 || stats.Written != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSyslogQueueBlock(t *testing.T) {
+	q, err := NewSyslogQueue(2, SyslogQueueBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		pushMessages(q, 3)
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push should block while queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Pop()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push should continue after popping")
+	}
+	if stats := q.Stats(); stats.Dropped != 0 || stats.Queued != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSyslogQueueUnknownPolicy(t *testing.T) {
+	if _, err := NewSyslogQueue(2, "drop-all"); err == nil {
+		t.Fatal("unknown policy should fail")
+	}
+}
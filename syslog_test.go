@@ -0,0 +1,46 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSyslogListener(t *testing.T) {
+	cases := []struct {
+		arg      string
+		expected SyslogListener
+	}{
+		{"udp://127.0.0.1:514", SyslogListener{"udp", "127.0.0.1:514", ""}},
+		{"udp://[::1]:514?tag=lb1", SyslogListener{"udp", "[::1]:514", "lb1"}},
+		{"tcp://0.0.0.0:1514", SyslogListener{"tcp", "0.0.0.0:1514", ""}},
+		{"unix:///var/lib/haproxy/log?tag=lb2", SyslogListener{"unix", "/var/lib/haproxy/log", "lb2"}},
+	}
+	for _, c := range cases {
+		l, err := ParseSyslogListener(c.arg)
+		if err != nil {
+			t.Fatalf("%s: %v", c.arg, err)
+		}
+		if l != c.expected {
+			t.Errorf("%s: expected %+v, found %+v", c.arg, c.expected, l)
+		}
+	}
+
+	for _, arg := range []string{"127.0.0.1:514", "udp://127.0.0.1", "unix://", "http://127.0.0.1:514"} {
+		if _, err := ParseSyslogListener(arg); err == nil {
+			t.Errorf("%s: error expected", arg)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var templateFuncs = template.FuncMap{
+	// env returns the value of an environment variable, or an empty string
+	// if it is not set
+	"env": os.Getenv,
+
+	// file returns the content of a file, as a secret mounted in the
+	// container
+	"file": func(path string) (string, error) {
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(d), nil
+	},
+
+	// default returns value if not empty, or def otherwise, it can be used
+	// in pipelines as in {{ env "PORT" | default "80" }}
+	"default": func(def, value string) string {
+		if len(value) == 0 {
+			return def
+		}
+		return value
+	},
+
+	"trim": strings.TrimSpace,
+}
+
+// ConfigTemplate renders haproxy configuration from a template.
+type ConfigTemplate struct {
+	sync.Mutex
+
+	source, output string
+}
+
+func NewConfigTemplate(source, output string) *ConfigTemplate {
+	return &ConfigTemplate{source: source, output: output}
+}
+
+// Render renders the template and atomically replaces the output file with
+// the result.
+func (t *ConfigTemplate) Render() error {
+	t.Lock()
+	defer t.Unlock()
+
+	rendered, err := t.execute()
+	if err != nil {
+		return err
+	}
+	// Rendered configuration can contain secrets read with file
+	return writeFileAtomic(t.output, rendered, 0600)
+}
+
+// Execute renders the template without writing the output file
+func (t *ConfigTemplate) Execute() ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.execute()
+}
+
+// ExecuteContent renders a template that would replace the current one,
+// without modifying any file
+func (t *ConfigTemplate) ExecuteContent(content []byte) ([]byte, error) {
+	return t.render(content)
+}
+
+func (t *ConfigTemplate) execute() ([]byte, error) {
+	content, err := ioutil.ReadFile(t.source)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read template: %v", err)
+	}
+	return t.render(content)
+}
+
+func (t *ConfigTemplate) render(content []byte) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(t.source)).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse template: %v", err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, nil); err != nil {
+		return nil, fmt.Errorf("couldn't render template: %v", err)
+	}
+	return rendered.Bytes(), nil
+}
+
+// templatedHaproxyServer renders the configuration template before starting
+// or reloading haproxy.
+type templatedHaproxyServer struct {
+	HaproxyServer
+	template *ConfigTemplate
+}
+
+func NewTemplatedHaproxyServer(haproxy HaproxyServer, template *ConfigTemplate) HaproxyServer {
+	return &templatedHaproxyServer{HaproxyServer: haproxy, template: template}
+}
+
+func (s *templatedHaproxyServer) Start() error {
+	if err := s.template.Render(); err != nil {
+		return err
+	}
+	return s.HaproxyServer.Start()
+}
+
+func (s *templatedHaproxyServer) Reload() error {
+	if err := s.template.Render(); err != nil {
+		return err
+	}
+	return s.HaproxyServer.Reload()
+}
+
+// PlanReload reports what a reload would do, if supported by the underlying
+// server.
+func (s *templatedHaproxyServer) PlanReload() (*HaproxyReloadPlan, error) {
+	planner, ok := s.HaproxyServer.(HaproxyReloadPlanner)
+	if !ok {
+		return nil, fmt.Errorf("haproxy server doesn't support planning reloads")
+	}
+	return planner.PlanReload()
+}
+
+// Signal forwards the signal to the underlying server, if supported.
+func (s *templatedHaproxyServer) Signal(signal os.Signal) error {
+	signaler, ok := s.HaproxyServer.(HaproxySignaler)
+	if !ok {
+		return fmt.Errorf("haproxy server cannot be signaled")
+	}
+	return signaler.Signal(signal)
+}
+
+// SetConfigHash forwards the hash to the underlying server, if supported.
+func (s *templatedHaproxyServer) SetConfigHash(hash string) {
+	if hasher, ok := s.HaproxyServer.(HaproxyConfigHasher); ok {
+		hasher.SetConfigHash(hash)
+	}
+}
+
+// SetNetQueueIPs forwards the IPs to the underlying server, if supported.
+func (s *templatedHaproxyServer) SetNetQueueIPs(ips []net.IP) error {
+	configurer, ok := s.HaproxyServer.(HaproxyNetQueueConfigurer)
+	if !ok {
+		return fmt.Errorf("haproxy server doesn't retain connections during reloads")
+	}
+	return configurer.SetNetQueueIPs(ips)
+}
+
+// templatedValidator renders the configuration template before validating.
+type templatedValidator struct {
+	HaproxyConfigValidator
+	template *ConfigTemplate
+}
+
+func NewTemplatedValidator(validator HaproxyConfigValidator, template *ConfigTemplate) HaproxyConfigValidator {
+	return &templatedValidator{HaproxyConfigValidator: validator, template: template}
+}
+
+func (v *templatedValidator) Validate() (ValidationResult, error) {
+	if err := v.template.Render(); err != nil {
+		result := ValidationResult{Items: []ValidationItem{{
+			Severity: ValidationAlert,
+			File:     v.template.source,
+			Message:  err.Error(),
+		}}}
+		return result, err
+	}
+	return v.HaproxyConfigValidator.Validate()
+}
+
+// ValidateContent validates configurations that would replace the rendered
+// one, if supported by the underlying validator.
+func (v *templatedValidator) ValidateContent(config []byte) (ValidationResult, error) {
+	validator, ok := v.HaproxyConfigValidator.(HaproxyContentValidator)
+	if !ok {
+		return ValidationResult{}, fmt.Errorf("validator doesn't support validating content")
+	}
+	return validator.ValidateContent(config)
+}
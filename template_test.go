@@ -0,0 +1,93 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testTemplate = `frontend http
+  bind *:{{ env "TEST_TEMPLATE_PORT" | default "80" }}
+  stats auth admin:{{ file "%s" | trim }}
+`
+
+func TestConfigTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "password")
+	ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600)
+
+	source := filepath.Join(dir, "haproxy.cfg.tmpl")
+	ioutil.WriteFile(source, []byte(fmt.Sprintf(testTemplate, secret)), 0644)
+
+	output := filepath.Join(dir, "haproxy.cfg")
+	tmpl := NewConfigTemplate(source, output)
+
+	os.Unsetenv("TEST_TEMPLATE_PORT")
+	if err := tmpl.Render(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "frontend http\n  bind *:80\n  stats auth admin:s3cr3t\n"
+	if d, _ := ioutil.ReadFile(output); string(d) != expected {
+		t.Fatalf("expected:\n%s\nfound:\n%s", expected, d)
+	}
+	// Output can contain secrets, and keeps its mode once it exists
+	if info, err := os.Stat(output); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("output with mode 0600 expected, found %v (%v)", info.Mode(), err)
+	}
+	os.Chmod(output, 0640)
+
+	os.Setenv("TEST_TEMPLATE_PORT", "8080")
+	defer os.Unsetenv("TEST_TEMPLATE_PORT")
+	if err := tmpl.Render(); err != nil {
+		t.Fatal(err)
+	}
+	expected = "frontend http\n  bind *:8080\n  stats auth admin:s3cr3t\n"
+	if d, _ := ioutil.ReadFile(output); string(d) != expected {
+		t.Fatalf("expected:\n%s\nfound:\n%s", expected, d)
+	}
+	if info, err := os.Stat(output); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("output expected to keep its mode, found %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestConfigTemplateErrorKeepsOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "haproxy.cfg.tmpl")
+	ioutil.WriteFile(source, []byte(`{{ file "/nonexistent" }}`), 0644)
+
+	output := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(output, []byte("global\n"), 0644)
+
+	if err := NewConfigTemplate(source, output).Render(); err == nil {
+		t.Fatal("rendering should fail")
+	}
+	if d, _ := ioutil.ReadFile(output); string(d) != "global\n" {
+		t.Fatalf("output shouldn't be modified, found: %s", d)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Severities of validation items
+const (
+	ValidationAlert   = "alert"
+	ValidationWarning = "warning"
+	ValidationNotice  = "notice"
+)
+
+// ValidationItem is a problem found while validating the configuration
+type ValidationItem struct {
+	Severity string `json:"severity"`
+	Rule     string `json:"rule,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ValidationResult contains the problems found while validating the
+// configuration.
+type ValidationResult struct {
+	Valid bool             `json:"valid"`
+	Items []ValidationItem `json:"items"`
+}
+
+// HasSeverity returns true if the result contains items of the given severity
+func (r ValidationResult) HasSeverity(severity string) bool {
+	for _, item := range r.Items {
+		if item.Severity == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// Lines as "[ALERT] 048/101112 (123) : message" in haproxy 1.8, or as
+// "[ALERT]    (123) : message" in newer versions
+var haproxyMessageRegexp = regexp.MustCompile(`^\[(ALERT|WARNING|NOTICE)\]\s+(?:\d+/\d+\s+)?(?:\(\d+\)\s+)?:\s*(.*)$`)
+
+// Location of the problem, as in "parsing [/etc/haproxy/haproxy.cfg:12] : "
+var haproxyLocationRegexp = regexp.MustCompile(`\[([^\[\]]+):(\d+)\]\s*:?\s*`)
+
+// parseHaproxyCheckOutput parses the output of haproxy -c
+func parseHaproxyCheckOutput(output string) []ValidationItem {
+	items := []ValidationItem{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := haproxyMessageRegexp.FindStringSubmatch(line)
+		if m == nil {
+			// Continuation of previous message
+			if len(items) > 0 && len(strings.TrimSpace(line)) > 0 && strings.HasPrefix(line, " ") {
+				last := &items[len(items)-1]
+				last.Message += "\n" + strings.TrimSpace(line)
+			}
+			continue
+		}
+		item := ValidationItem{
+			Severity: strings.ToLower(m[1]),
+			Message:  strings.TrimPrefix(m[2], "config : "),
+		}
+		if loc := haproxyLocationRegexp.FindStringSubmatchIndex(item.Message); loc != nil {
+			item.File = item.Message[loc[2]:loc[3]]
+			item.Line, _ = strconv.Atoi(item.Message[loc[4]:loc[5]])
+			item.Message = strings.TrimSpace(item.Message[:loc[0]] + item.Message[loc[1]:])
+			item.Message = strings.TrimPrefix(item.Message, "parsing ")
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,152 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const haproxyCheckOutput = `[ALERT] 048/101112 (123) : parsing [/etc/haproxy/haproxy.cfg:12] : unknown keyword 'foo' in 'global' section
+[WARNING] 048/101112 (123) : config : missing timeouts for frontend 'http'.
+   | While not properly invalid, you will certainly encounter various problems
+   | with such a configuration.
+[ALERT]    (1) : config : parsing [/etc/haproxy/conf.d/backends.cfg:3] : unknown keyword 'sever' in 'backend' section
+[ALERT] 048/101112 (123) : Error(s) found in configuration file : /etc/haproxy/haproxy.cfg
+`
+
+func TestParseHaproxyCheckOutput(t *testing.T) {
+	expected := []ValidationItem{
+		{Severity: ValidationAlert, File: "/etc/haproxy/haproxy.cfg", Line: 12, Message: "unknown keyword 'foo' in 'global' section"},
+		{Severity: ValidationWarning, Message: "missing timeouts for frontend 'http'.\n" +
+			"| While not properly invalid, you will certainly encounter various problems\n" +
+			"| with such a configuration."},
+		{Severity: ValidationAlert, File: "/etc/haproxy/conf.d/backends.cfg", Line: 3, Message: "unknown keyword 'sever' in 'backend' section"},
+		{Severity: ValidationAlert, Message: "Error(s) found in configuration file : /etc/haproxy/haproxy.cfg"},
+	}
+	items := parseHaproxyCheckOutput(haproxyCheckOutput)
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("expected:\n%+v\nfound:\n%+v", expected, items)
+	}
+
+	if items := parseHaproxyCheckOutput("Configuration file is valid\n"); len(items) != 0 {
+		t.Fatalf("no items expected, found: %+v", items)
+	}
+}
+
+// fakeHaproxyBinary creates a script that prints the given output and exits
+// with the given code
+func fakeHaproxyBinary(dir, output string, code int) (string, error) {
+	path := filepath.Join(dir, "haproxy")
+	script := fmt.Sprintf("#!/bin/sh\ncat <<'EOF'\n%sEOF\nexit %d\n", output, code)
+	return path, ioutil.WriteFile(path, []byte(script), 0755)
+}
+
+func TestHaproxyDashCStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := "[WARNING] 048/101112 (123) : config : missing timeouts for frontend 'http'.\nConfiguration file is valid\n"
+	path, err := fakeHaproxyBinary(dir, output, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewHaproxyDashC(path, []string{"haproxy.cfg"}, false).Validate()
+	if err != nil || !result.Valid || len(result.Items) != 1 {
+		t.Fatalf("valid configuration with warnings expected, found: %+v (%v)", result, err)
+	}
+
+	result, err = NewHaproxyDashC(path, []string{"haproxy.cfg"}, true).Validate()
+	if err == nil || result.Valid {
+		t.Fatalf("invalid configuration expected in strict mode, found: %+v", result)
+	}
+}
+
+// Fake haproxy that fails if the configuration contains "invalid", reporting
+// the working directory in the alert
+const fakeHaproxyCheckScript = `#!/bin/sh
+if grep -q invalid "$3"; then
+	echo "[ALERT] 048/101112 (123) : parsing [$3:1] : invalid configuration in $(pwd)"
+	exit 1
+fi
+if [ -n "$5" ] && [ ! -e "$5" ]; then
+	echo "[ALERT] 048/101112 (123) : Could not open configuration file $5"
+	exit 1
+fi
+echo "Configuration file is valid"
+`
+
+func TestHaproxyDashCValidateContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "haproxy")
+	if err := ioutil.WriteFile(path, []byte(fakeHaproxyCheckScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	configDir := filepath.Join(dir, "etc")
+	os.Mkdir(configDir, 0755)
+	config := filepath.Join(configDir, "haproxy.cfg")
+	ioutil.WriteFile(config, []byte("global\n"), 0644)
+
+	validator := NewHaproxyDashC(path, []string{config}, false)
+
+	result, err := validator.ValidateContent([]byte("global\n  maxconn 100\n"))
+	if err != nil || !result.Valid {
+		t.Fatalf("valid configuration expected, found: %+v (%v)", result, err)
+	}
+
+	result, err = validator.ValidateContent([]byte("invalid\n"))
+	if err == nil || result.Valid || len(result.Items) != 1 {
+		t.Fatalf("invalid configuration expected, found: %+v", result)
+	}
+	item := result.Items[0]
+	if item.File != config || item.Message != "invalid configuration in "+configDir {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+
+	if d, _ := ioutil.ReadFile(config); string(d) != "global\n" {
+		t.Fatalf("running configuration shouldn't be modified, found: %s", d)
+	}
+
+	// Additional files relative to the working directory of the wrapper
+	extra := filepath.Join(dir, "extra.cfg")
+	ioutil.WriteFile(extra, []byte("defaults\n"), 0644)
+	wd, _ := os.Getwd()
+	relative, err := filepath.Rel(wd, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator = NewHaproxyDashC(path, []string{config, relative}, false)
+	if result, err := validator.ValidateContent([]byte("global\n")); err != nil || !result.Valid {
+		t.Fatalf("valid configuration expected, found: %+v (%v)", result, err)
+	}
+
+	validator = NewHaproxyDashC(path, []string{configDir}, false)
+	if _, err := validator.ValidateContent([]byte("global\n")); err == nil {
+		t.Fatal("error expected when replacing a configuration directory")
+	}
+}
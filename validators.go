@@ -0,0 +1,304 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ValidatorChain validates configuration with multiple validators, it is
+// valid only if all of them consider it valid. All validators are run, so all
+// problems are reported at once.
+type ValidatorChain []HaproxyConfigValidator
+
+func (c ValidatorChain) run(validate func(HaproxyConfigValidator) (ValidationResult, error)) (ValidationResult, error) {
+	result := ValidationResult{Valid: true, Items: []ValidationItem{}}
+	var errs []string
+	for _, v := range c {
+		r, err := validate(v)
+		result.Items = append(result.Items, r.Items...)
+		if err != nil {
+			result.Valid = false
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return result, nil
+}
+
+func (c ValidatorChain) Validate() (ValidationResult, error) {
+	return c.run(func(v HaproxyConfigValidator) (ValidationResult, error) {
+		return v.Validate()
+	})
+}
+
+// ValidateContent validates a configuration that would replace the first
+// configuration file, all validators in the chain must support it.
+func (c ValidatorChain) ValidateContent(config []byte) (ValidationResult, error) {
+	return c.run(func(v HaproxyConfigValidator) (ValidationResult, error) {
+		cv, ok := v.(HaproxyContentValidator)
+		if !ok {
+			return ValidationResult{}, fmt.Errorf("validator doesn't support validating content")
+		}
+		return cv.ValidateContent(config)
+	})
+}
+
+// ScriptValidator validates configuration with an external script, that
+// receives the configuration files as arguments. Configuration is invalid if
+// the script fails.
+type ScriptValidator struct {
+	script      string
+	configFiles []string
+}
+
+func NewScriptValidator(script string, configFiles []string) *ScriptValidator {
+	return &ScriptValidator{script: script, configFiles: configFiles}
+}
+
+func (v *ScriptValidator) Validate() (ValidationResult, error) {
+	return v.run(v.configFiles)
+}
+
+func (v *ScriptValidator) ValidateContent(config []byte) (ValidationResult, error) {
+	dir, err := ioutil.TempDir("", "haproxy-validate")
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	configFiles, err := replaceConfigFile(v.configFiles, config, dir)
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	return v.run(configFiles)
+}
+
+func (v *ScriptValidator) run(configFiles []string) (ValidationResult, error) {
+	out, err := reaper.CombinedOutput(exec.Command(v.script, configFiles...))
+	if err != nil {
+		item := ValidationItem{
+			Severity: ValidationAlert,
+			Rule:     "script",
+			Message:  strings.TrimSpace(string(out)),
+		}
+		return ValidationResult{Items: []ValidationItem{item}}, fmt.Errorf("%s failed: %v:\n%s", v.script, err, out)
+	}
+	return ValidationResult{Valid: true, Items: []ValidationItem{}}, nil
+}
+
+// A PolicyRule checks that a configuration follows some policy
+type PolicyRule struct {
+	Name        string
+	Description string
+	Check       func(*HaproxyConfig) []ValidationItem
+}
+
+// PolicyRules are the policies that can be checked by a PolicyValidator
+var PolicyRules = []PolicyRule{
+	{
+		Name:        "backend-health-checks",
+		Description: "Every server in backends has health checks enabled",
+		Check:       checkBackendHealthChecks,
+	},
+	{
+		Name:        "no-tcp-on-port-80",
+		Description: "No frontend in TCP mode binds port 80",
+		Check:       checkNoTCPOnPort80,
+	},
+	{
+		Name:        "defaults-timeouts",
+		Description: "Connect, client and server timeouts are defined in defaults",
+		Check:       checkDefaultsTimeouts,
+	},
+	{
+		Name:        "stats-socket-expose-fd",
+		Description: "Stats socket is enabled with expose-fd listeners",
+		Check:       checkStatsSocketExposeFd,
+	},
+}
+
+func policyItem(rule, file string, line int, format string, v ...interface{}) ValidationItem {
+	return ValidationItem{
+		Severity: ValidationAlert,
+		Rule:     rule,
+		File:     file,
+		Line:     line,
+		Message:  fmt.Sprintf(format, v...),
+	}
+}
+
+func defaultServerChecks(section *ConfigSection) bool {
+	if section == nil {
+		return false
+	}
+	for _, line := range section.Find("default-server") {
+		if line.HasField("check") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkBackendHealthChecks(c *HaproxyConfig) []ValidationItem {
+	var items []ValidationItem
+	for _, section := range c.SectionsOf("backend", "listen") {
+		if defaultServerChecks(section) || defaultServerChecks(c.DefaultsFor(section)) {
+			continue
+		}
+		for _, line := range section.Find("server") {
+			if !line.HasField("check") {
+				items = append(items, policyItem("backend-health-checks", line.File, line.Number,
+					"server without health checks in %s %s", section.Type, section.Name))
+			}
+		}
+	}
+	return items
+}
+
+func sectionMode(c *HaproxyConfig, section *ConfigSection) string {
+	mode := "tcp"
+	if defaults := c.DefaultsFor(section); defaults != nil {
+		for _, line := range defaults.Find("mode") {
+			if len(line.Fields) > 1 {
+				mode = line.Fields[1]
+			}
+		}
+	}
+	for _, line := range section.Find("mode") {
+		if len(line.Fields) > 1 {
+			mode = line.Fields[1]
+		}
+	}
+	return mode
+}
+
+func checkNoTCPOnPort80(c *HaproxyConfig) []ValidationItem {
+	var items []ValidationItem
+	for _, section := range c.SectionsOf("frontend", "listen") {
+		if sectionMode(c, section) != "tcp" {
+			continue
+		}
+		for _, line := range section.Find("bind") {
+			if len(line.Fields) < 2 {
+				continue
+			}
+			for _, addr := range strings.Split(line.Fields[1], ",") {
+				if strings.HasSuffix(addr, ":80") {
+					items = append(items, policyItem("no-tcp-on-port-80", line.File, line.Number,
+						"%s %s in TCP mode binds port 80", section.Type, section.Name))
+				}
+			}
+		}
+	}
+	return items
+}
+
+func checkDefaultsTimeouts(c *HaproxyConfig) []ValidationItem {
+	var items []ValidationItem
+	defaults := c.SectionsOf("defaults")
+	if len(defaults) == 0 {
+		return []ValidationItem{policyItem("defaults-timeouts", "", 0, "no defaults section found")}
+	}
+	for _, section := range defaults {
+		for _, timeout := range []string{"connect", "client", "server"} {
+			if len(section.Find("timeout", timeout)) == 0 {
+				items = append(items, policyItem("defaults-timeouts", section.File, section.Line,
+					"timeout %s not defined in defaults", timeout))
+			}
+		}
+	}
+	return items
+}
+
+func checkStatsSocketExposeFd(c *HaproxyConfig) []ValidationItem {
+	for _, section := range c.SectionsOf("global") {
+		for _, line := range section.Find("stats", "socket") {
+			for i := range line.Fields[:len(line.Fields)-1] {
+				if line.Fields[i] == "expose-fd" && line.Fields[i+1] == "listeners" {
+					return nil
+				}
+			}
+		}
+	}
+	return []ValidationItem{policyItem("stats-socket-expose-fd", "", 0, "no stats socket with expose-fd listeners found in global section")}
+}
+
+// PolicyValidator checks that configuration follows some policy rules
+type PolicyValidator struct {
+	configFiles []string
+	rules       []PolicyRule
+}
+
+// NewPolicyValidator returns a validator that checks the given rules, "all"
+// can be used to check all known rules.
+func NewPolicyValidator(configFiles []string, ruleNames []string) (*PolicyValidator, error) {
+	v := &PolicyValidator{configFiles: configFiles}
+	for _, name := range ruleNames {
+		if name == "all" {
+			v.rules = PolicyRules
+			return v, nil
+		}
+		found := false
+		for _, rule := range PolicyRules {
+			if rule.Name == name {
+				v.rules = append(v.rules, rule)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown policy rule: %s", name)
+		}
+	}
+	return v, nil
+}
+
+func (v *PolicyValidator) Validate() (ValidationResult, error) {
+	return v.check(nil)
+}
+
+func (v *PolicyValidator) ValidateContent(config []byte) (ValidationResult, error) {
+	return v.check(config)
+}
+
+func (v *PolicyValidator) check(replacement []byte) (ValidationResult, error) {
+	config, err := ParseHaproxyConfigFiles(v.configFiles, replacement)
+	if err != nil {
+		item := ValidationItem{Severity: ValidationAlert, Message: err.Error()}
+		return ValidationResult{Items: []ValidationItem{item}}, err
+	}
+
+	result := ValidationResult{Items: []ValidationItem{}}
+	var failed []string
+	for _, rule := range v.rules {
+		items := rule.Check(config)
+		if len(items) > 0 {
+			failed = append(failed, rule.Name)
+			result.Items = append(result.Items, items...)
+		}
+	}
+	if len(failed) > 0 {
+		return result, fmt.Errorf("policy rules failed: %s", strings.Join(failed, ", "))
+	}
+	result.Valid = true
+	return result, nil
+}
@@ -0,0 +1,170 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const policyCompliantConfig = `global
+  stats socket /var/run/haproxy.sock mode 600 expose-fd listeners level admin
+
+defaults
+  mode http
+  timeout connect 5s
+  timeout client 30s
+  timeout server 30s
+
+frontend http
+  bind *:80
+  default_backend app
+
+frontend db
+  mode tcp
+  bind *:5432
+  default_backend db
+
+backend app
+  server app1 10.0.0.1:8080 check
+  server app2 10.0.0.2:8080 check # comment
+
+backend db
+  mode tcp
+  default-server check
+  server db1 10.0.0.3:5432
+`
+
+const policyViolatingConfig = `global
+  stats socket /var/run/haproxy.sock mode 600 level admin
+
+defaults
+  timeout connect 5s
+  timeout client 30s
+
+frontend http
+  bind *:80
+  default_backend app
+
+backend app
+  server app1 10.0.0.1:8080 check
+  server app2 10.0.0.2:8080
+`
+
+func writeTestConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "validators")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func TestPolicyValidator(t *testing.T) {
+	config, cleanup := writeTestConfig(t, policyCompliantConfig)
+	defer cleanup()
+
+	v, err := NewPolicyValidator([]string{config}, []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := v.Validate()
+	if err != nil || !result.Valid || len(result.Items) != 0 {
+		t.Fatalf("valid configuration expected, found: %+v (%v)", result, err)
+	}
+
+	result, err = v.ValidateContent([]byte(policyViolatingConfig))
+	if err == nil || result.Valid {
+		t.Fatalf("invalid configuration expected, found: %+v", result)
+	}
+	failed := make(map[string]int)
+	for _, item := range result.Items {
+		failed[item.Rule]++
+	}
+	expected := map[string]int{
+		"backend-health-checks":  1,
+		"no-tcp-on-port-80":      1,
+		"defaults-timeouts":      1,
+		"stats-socket-expose-fd": 1,
+	}
+	if !reflect.DeepEqual(failed, expected) {
+		t.Fatalf("expected failed rules %v, found %v: %+v", expected, failed, result.Items)
+	}
+	for _, item := range result.Items {
+		if item.Rule == "backend-health-checks" && item.Line != 14 {
+			t.Fatalf("unexpected line for server without checks: %+v", item)
+		}
+	}
+}
+
+func TestPolicyValidatorRuleSelection(t *testing.T) {
+	config, cleanup := writeTestConfig(t, policyViolatingConfig)
+	defer cleanup()
+
+	v, err := NewPolicyValidator([]string{config}, []string{"defaults-timeouts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ := v.Validate()
+	for _, item := range result.Items {
+		if item.Rule != "defaults-timeouts" {
+			t.Fatalf("only enabled rule expected, found: %+v", item)
+		}
+	}
+
+	if _, err := NewPolicyValidator([]string{config}, []string{"unknown"}); err == nil {
+		t.Fatal("unknown rule should fail")
+	}
+}
+
+func TestValidatorChain(t *testing.T) {
+	failing := &fakeValidator{err: fmt.Errorf("invalid")}
+	chain := ValidatorChain{&fakeValidator{}, failing, &fakeValidator{}}
+
+	result, err := chain.Validate()
+	if err == nil || result.Valid || len(result.Items) != 1 {
+		t.Fatalf("invalid configuration expected, found: %+v", result)
+	}
+
+	failing.SetError(nil)
+	result, err = chain.Validate()
+	if err != nil || !result.Valid {
+		t.Fatalf("valid configuration expected, found: %+v (%v)", result, err)
+	}
+}
+
+func TestScriptValidator(t *testing.T) {
+	config, cleanup := writeTestConfig(t, "global\n")
+	defer cleanup()
+
+	script := filepath.Join(filepath.Dir(config), "check.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nif grep -q forbidden \"$1\"; then echo forbidden keyword; exit 1; fi\n"), 0755)
+
+	v := NewScriptValidator(script, []string{config})
+	if result, err := v.Validate(); err != nil || !result.Valid {
+		t.Fatalf("valid configuration expected, found: %+v (%v)", result, err)
+	}
+	result, err := v.ValidateContent([]byte("forbidden\n"))
+	if err == nil || len(result.Items) != 1 || result.Items[0].Message != "forbidden keyword" {
+		t.Fatalf("invalid configuration expected, found: %+v", result)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// watchedDirs returns the directories that need to be watched to detect
+// changes in the given paths.
+func watchedDirs(paths []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dir = path
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// ConfigWatcher watches haproxy configuration files and reloads haproxy when
+// their content changes, only if the new configuration is valid.
+type ConfigWatcher struct {
+	sync.Mutex
+
+	paths     []string
+	debounce  time.Duration
+	jobs      *ReloadJobs
+	validator HaproxyConfigValidator
+
+	lastHash string
+	inotify  *os.File
+}
+
+func NewConfigWatcher(paths []string, debounce time.Duration, jobs *ReloadJobs, validator HaproxyConfigValidator) *ConfigWatcher {
+	return &ConfigWatcher{
+		paths:     paths,
+		debounce:  debounce,
+		jobs:      jobs,
+		validator: validator,
+	}
+}
+
+func (w *ConfigWatcher) Start() error {
+	if w.inotify != nil {
+		return fmt.Errorf("watcher already started")
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("couldn't initialize inotify: %v", err)
+	}
+	w.inotify = os.NewFile(uintptr(fd), "inotify")
+
+	for _, dir := range watchedDirs(w.paths) {
+		if _, err := syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+			w.inotify.Close()
+			w.inotify = nil
+			return fmt.Errorf("couldn't watch %s: %v", dir, err)
+		}
+		log.Printf("Watching %s for configuration changes\n", dir)
+	}
+
+	if hash, err := configHash(w.paths); err == nil {
+		w.lastHash = hash
+	}
+
+	events := make(chan struct{})
+	go w.read(w.inotify, events)
+	go w.loop(events)
+	return nil
+}
+
+func (w *ConfigWatcher) Stop() error {
+	if w.inotify == nil {
+		return fmt.Errorf("watcher not started")
+	}
+	err := w.inotify.Close()
+	w.inotify = nil
+	return err
+}
+
+// read notifies about any event found in the inotify file, we don't need to
+// parse them, as any event triggers a check of all the files.
+func (w *ConfigWatcher) read(f *os.File, events chan<- struct{}) {
+	defer close(events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			events <- struct{}{}
+		}
+	}
+}
+
+func (w *ConfigWatcher) loop(events <-chan struct{}) {
+	var timer <-chan time.Time
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			timer = time.After(w.debounce)
+		case <-timer:
+			timer = nil
+			if err := w.Check(); err != nil {
+				log.Printf("Configuration change not applied: %v\n", err)
+			}
+		}
+	}
+}
+
+// Check reloads haproxy if the configuration has changed since last check and
+// it is valid.
+func (w *ConfigWatcher) Check() error {
+	w.Lock()
+	defer w.Unlock()
+
+	hash, err := configHash(w.paths)
+	if err != nil {
+		return err
+	}
+	if hash == w.lastHash {
+		return nil
+	}
+
+	_, err = w.validator.Validate()
+
+	// Hash is calculated again, as validation could have modified the
+	// files, as when rendering templates. Invalid configurations are not
+	// checked again till they change.
+	if hash, herr := configHash(w.paths); herr == nil {
+		w.lastHash = hash
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	log.Println("Configuration changed, reloading")
+	if _, err := w.jobs.Reload(false); err != nil {
+		return fmt.Errorf("couldn't reload: %v", err)
+	}
+	return nil
+}
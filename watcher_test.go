@@ -0,0 +1,170 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeHaproxy struct {
+	sync.Mutex
+	running bool
+	reloads int
+}
+
+func (h *fakeHaproxy) Start() error {
+	h.Lock()
+	defer h.Unlock()
+	h.running = true
+	return nil
+}
+
+func (h *fakeHaproxy) Stop() error {
+	h.Lock()
+	defer h.Unlock()
+	h.running = false
+	return nil
+}
+
+func (h *fakeHaproxy) Reload() error {
+	h.Lock()
+	defer h.Unlock()
+	h.reloads++
+	return nil
+}
+
+func (h *fakeHaproxy) IsRunning() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.running
+}
+
+func (h *fakeHaproxy) Reloads() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.reloads
+}
+
+type fakeValidator struct {
+	sync.Mutex
+	err error
+}
+
+func (v *fakeValidator) Validate() (ValidationResult, error) {
+	v.Lock()
+	defer v.Unlock()
+	if v.err != nil {
+		return ValidationResult{Items: []ValidationItem{{Severity: ValidationAlert, Message: v.err.Error()}}}, v.err
+	}
+	return ValidationResult{Valid: true, Items: []ValidationItem{}}, nil
+}
+
+func (v *fakeValidator) SetError(err error) {
+	v.Lock()
+	defer v.Unlock()
+	v.err = err
+}
+
+func waitForReloads(h *fakeHaproxy, n int) error {
+	for retries := 50; retries > 0; retries-- {
+		if h.Reloads() >= n {
+			return nil
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	return fmt.Errorf("expected %d reloads, found %d", n, h.Reloads())
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(config, []byte("global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	haproxy := &fakeHaproxy{running: true}
+	validator := &fakeValidator{}
+	w := NewConfigWatcher([]string{config}, 10*time.Millisecond, NewReloadJobs(NewReloader(haproxy, []string{config}, validator, nil, nil), reloadJobsHistory), validator)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// Same content doesn't reload
+	ioutil.WriteFile(config, []byte("global\n"), 0644)
+	<-time.After(100 * time.Millisecond)
+	if n := haproxy.Reloads(); n != 0 {
+		t.Fatalf("no reload expected, found %d", n)
+	}
+
+	ioutil.WriteFile(config, []byte("global\n  maxconn 100\n"), 0644)
+	if err := waitForReloads(haproxy, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid configuration doesn't reload
+	validator.SetError(fmt.Errorf("invalid"))
+	ioutil.WriteFile(config, []byte("global\n  maxconn foo\n"), 0644)
+	<-time.After(100 * time.Millisecond)
+	if n := haproxy.Reloads(); n != 1 {
+		t.Fatalf("only one reload expected, found %d", n)
+	}
+}
+
+func TestConfigWatcherSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Emulate the layout of Kubernetes ConfigMap volumes
+	writeVersion := func(version, content string) {
+		versionDir := filepath.Join(dir, version)
+		os.Mkdir(versionDir, 0755)
+		ioutil.WriteFile(filepath.Join(versionDir, "haproxy.cfg"), []byte(content), 0644)
+		tmp := filepath.Join(dir, "..data_tmp")
+		os.Symlink(version, tmp)
+		os.Rename(tmp, filepath.Join(dir, "..data"))
+	}
+	writeVersion("..v1", "global\n")
+	config := filepath.Join(dir, "haproxy.cfg")
+	if err := os.Symlink("..data/haproxy.cfg", config); err != nil {
+		t.Fatal(err)
+	}
+
+	haproxy := &fakeHaproxy{running: true}
+	w := NewConfigWatcher([]string{config}, 10*time.Millisecond, NewReloadJobs(NewReloader(haproxy, []string{config}, &fakeValidator{}, nil, nil), reloadJobsHistory), &fakeValidator{})
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	writeVersion("..v2", "global\n  maxconn 100\n")
+	if err := waitForReloads(haproxy, 1); err != nil {
+		t.Fatal(err)
+	}
+}
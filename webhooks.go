@@ -0,0 +1,284 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Header with the HMAC-SHA256 signature of the payload
+const webhookSignatureHeader = "X-Haproxy-Wrapper-Signature"
+
+const webhookTimeout = 10 * time.Second
+
+// Events notified to webhooks
+var webhookEvents = map[string]bool{
+	EventReloadSucceeded: true,
+	EventReloadFailed:    true,
+	EventHaproxyCrashed:  true,
+}
+
+// WebhookPayload is the body of the requests sent to webhooks
+type WebhookPayload struct {
+	Event
+	Host string `json:"host"`
+}
+
+// WebhookStats are the counters of notifications of a webhook
+type WebhookStats struct {
+	URL     string `json:"url"`
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type webhook struct {
+	url   string
+	queue chan []byte
+	stats WebhookStats
+	stop  chan struct{}
+}
+
+func newWebhook(url string, queueSize int) *webhook {
+	return &webhook{
+		url:   url,
+		queue: make(chan []byte, queueSize),
+		stats: WebhookStats{URL: url},
+		stop:  make(chan struct{}),
+	}
+}
+
+// WebhookNotifier sends reload results and haproxy crashes to webhooks. Each
+// webhook has its own bounded queue, so a slow webhook doesn't delay the
+// others, and notifications are dropped if it is full.
+type WebhookNotifier struct {
+	sync.Mutex
+
+	webhooks      []*webhook
+	secret        []byte
+	retries       int
+	retryInterval time.Duration
+	client        *http.Client
+	host          string
+
+	cancel func()
+	done   chan struct{}
+}
+
+// NewWebhookNotifier returns a notifier for the given URLs, payloads are
+// signed if secret is not empty. Failed notifications are retried with
+// exponential backoff starting in retryInterval.
+func NewWebhookNotifier(urls []string, secret []byte, queueSize, retries int, retryInterval time.Duration) *WebhookNotifier {
+	host, _ := os.Hostname()
+	n := &WebhookNotifier{
+		secret:        secret,
+		retries:       retries,
+		retryInterval: retryInterval,
+		client:        &http.Client{Timeout: webhookTimeout},
+		host:          host,
+	}
+	for _, url := range urls {
+		n.webhooks = append(n.webhooks, newWebhook(url, queueSize))
+	}
+	return n
+}
+
+// Reconfigure replaces the webhooks and their settings. Webhooks whose URL and
+// queue size don't change keep their queued notifications and counters.
+func (n *WebhookNotifier) Reconfigure(urls []string, secret []byte, queueSize, retries int) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.secret = secret
+	n.retries = retries
+
+	current := make(map[string]*webhook)
+	for _, w := range n.webhooks {
+		current[w.url] = w
+	}
+	var webhooks []*webhook
+	for _, url := range urls {
+		if w, found := current[url]; found && cap(w.queue) == queueSize {
+			webhooks = append(webhooks, w)
+			delete(current, url)
+			continue
+		}
+		w := newWebhook(url, queueSize)
+		if previous, found := current[url]; found {
+			w.stats = previous.stats
+		}
+		webhooks = append(webhooks, w)
+		if n.done != nil {
+			go n.deliver(w, n.done)
+		}
+	}
+	for _, w := range current {
+		close(w.stop)
+	}
+	n.webhooks = webhooks
+}
+
+// Start starts sending notifications for the events published in the bus
+func (n *WebhookNotifier) Start(events *EventBus) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.done != nil {
+		return fmt.Errorf("notifier already started")
+	}
+	n.done = make(chan struct{})
+
+	for _, w := range n.webhooks {
+		go n.deliver(w, n.done)
+	}
+	// Events are handled by publishers, so they are only dropped if the
+	// queue of a webhook is full, and then they are counted.
+	n.cancel = events.Handle(func(e Event) {
+		if webhookEvents[e.Type] {
+			n.notify(e)
+		}
+	})
+	return nil
+}
+
+func (n *WebhookNotifier) Stop() error {
+	n.Lock()
+	defer n.Unlock()
+	if n.done == nil {
+		return fmt.Errorf("notifier not started")
+	}
+	n.cancel()
+	close(n.done)
+	n.done = nil
+	return nil
+}
+
+func (n *WebhookNotifier) notify(e Event) {
+	payload, err := json.Marshal(WebhookPayload{Event: e, Host: n.host})
+	if err != nil {
+		log.Printf("Couldn't encode webhook payload: %v\n", err)
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	for _, w := range n.webhooks {
+		select {
+		case w.queue <- payload:
+		default:
+			log.Printf("Webhook queue for %s full, dropping %s notification\n", w.url, e.Type)
+			w.stats.Dropped++
+		}
+	}
+}
+
+func (n *WebhookNotifier) deliver(w *webhook, done chan struct{}) {
+	for {
+		var payload []byte
+		select {
+		case payload = <-w.queue:
+		case <-w.stop:
+			return
+		case <-done:
+			return
+		}
+
+		n.Lock()
+		secret, retries := n.secret, n.retries
+		n.Unlock()
+
+		interval := n.retryInterval
+		err := n.send(w.url, secret, payload)
+		for i := 0; err != nil && i < retries; i++ {
+			select {
+			case <-time.After(interval):
+			case <-w.stop:
+				return
+			case <-done:
+				return
+			}
+			interval *= 2
+			err = n.send(w.url, secret, payload)
+		}
+
+		n.Lock()
+		if err != nil {
+			log.Printf("Couldn't notify webhook %s: %v\n", w.url, err)
+			w.stats.Failed++
+		} else {
+			w.stats.Sent++
+		}
+		n.Unlock()
+	}
+}
+
+func (n *WebhookNotifier) send(url string, secret, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(secret, payload))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// readWebhookSecret reads the secret used to sign payloads, surrounding
+// spaces are ignored.
+func readWebhookSecret(path string) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(secret), nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the payload
+func signPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *WebhookNotifier) Status() interface{} {
+	n.Lock()
+	defer n.Unlock()
+	stats := make([]WebhookStats, len(n.webhooks))
+	for i, w := range n.webhooks {
+		stats[i] = w.stats
+	}
+	return stats
+}
@@ -0,0 +1,168 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookReceiver records the payloads received, failing the first
+// requests
+type testWebhookReceiver struct {
+	sync.Mutex
+	failures   int
+	payloads   [][]byte
+	signatures []string
+}
+
+func (r *testWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	payload, _ := ioutil.ReadAll(req.Body)
+	r.payloads = append(r.payloads, payload)
+	r.signatures = append(r.signatures, req.Header.Get(webhookSignatureHeader))
+}
+
+func (r *testWebhookReceiver) Received() ([][]byte, []string) {
+	r.Lock()
+	defer r.Unlock()
+	return r.payloads, r.signatures
+}
+
+func waitForStats(n *WebhookNotifier, check func(WebhookStats) bool) (WebhookStats, bool) {
+	for i := 0; i < 200; i++ {
+		stats := n.Status().([]WebhookStats)[0]
+		if check(stats) {
+			return stats, true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n.Status().([]WebhookStats)[0], false
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	receiver := &testWebhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	events := NewEventBus()
+	secret := []byte("s3cr3t")
+	notifier := NewWebhookNotifier([]string{server.URL}, secret, 10, 3, time.Millisecond)
+	if err := notifier.Start(events); err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Stop()
+
+	events.Publish(EventReloadRequested, nil)
+	events.Publish(EventReloadFailed, map[string]interface{}{"error": "invalid configuration"})
+
+	if stats, ok := waitForStats(notifier, func(s WebhookStats) bool { return s.Sent == 1 }); !ok {
+		t.Fatalf("notification should be sent after retries, found: %+v", stats)
+	}
+
+	payloads, signatures := receiver.Received()
+	if len(payloads) != 1 {
+		t.Fatalf("one notification expected, found %d", len(payloads))
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(payloads[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Type != EventReloadFailed || payload.Data["error"] != "invalid configuration" {
+		t.Fatalf("unexpected payload: %s", payloads[0])
+	}
+	if signatures[0] != "sha256="+signPayload(secret, payloads[0]) {
+		t.Fatalf("incorrect signature: %s", signatures[0])
+	}
+}
+
+func TestWebhookNotifierFailures(t *testing.T) {
+	receiver := &testWebhookReceiver{failures: 100}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	events := NewEventBus()
+	notifier := NewWebhookNotifier([]string{server.URL}, nil, 1, 1, 50*time.Millisecond)
+	if err := notifier.Start(events); err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Stop()
+
+	// While the first notification is retried, the second one is queued
+	// and the rest are dropped, all of them are accounted even if they are
+	// more than what the event bus buffers
+	n := uint64(2 * eventSubscriberBufferSize)
+	for i := uint64(0); i < n; i++ {
+		events.Publish(EventHaproxyCrashed, nil)
+	}
+
+	stats, ok := waitForStats(notifier, func(s WebhookStats) bool { return s.Failed+s.Dropped == n })
+	if !ok || stats.Sent != 0 || stats.Dropped == 0 {
+		t.Fatalf("failed and dropped notifications expected, found: %+v", stats)
+	}
+	if _, signatures := receiver.Received(); len(signatures) != 0 {
+		t.Fatalf("no notifications should be received, found %d", len(signatures))
+	}
+}
+
+func TestWebhookNotifierReconfigure(t *testing.T) {
+	first := &testWebhookReceiver{}
+	firstServer := httptest.NewServer(first)
+	defer firstServer.Close()
+	second := &testWebhookReceiver{}
+	secondServer := httptest.NewServer(second)
+	defer secondServer.Close()
+
+	events := NewEventBus()
+	notifier := NewWebhookNotifier(nil, nil, 10, 0, time.Millisecond)
+	if err := notifier.Start(events); err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Stop()
+
+	notifier.Reconfigure([]string{firstServer.URL}, nil, 10, 0)
+	events.Publish(EventReloadSucceeded, nil)
+	if _, ok := waitForStats(notifier, func(s WebhookStats) bool { return s.Sent == 1 }); !ok {
+		t.Fatal("notification not sent to the first webhook")
+	}
+
+	notifier.Reconfigure([]string{secondServer.URL}, []byte("s3cr3t"), 10, 0)
+	events.Publish(EventReloadSucceeded, nil)
+	if _, ok := waitForStats(notifier, func(s WebhookStats) bool { return s.Sent == 1 }); !ok {
+		t.Fatal("notification not sent to the second webhook")
+	}
+	if stats := notifier.Status().([]WebhookStats); len(stats) != 1 || stats[0].URL != secondServer.URL {
+		t.Fatalf("unexpected webhooks after reconfiguration: %+v", stats)
+	}
+
+	if payloads, _ := first.Received(); len(payloads) != 1 {
+		t.Fatalf("1 notification expected in the first webhook, found %d", len(payloads))
+	}
+	_, signatures := second.Received()
+	if len(signatures) != 1 || len(signatures[0]) == 0 {
+		t.Fatalf("signed notification expected in the second webhook, found %v", signatures)
+	}
+}
@@ -0,0 +1,485 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the environment variables that override flags, followed by the
+// name of the flag in upper case and with underscores, as in
+// HAPROXY_WRAPPER_SYSLOG_MIN_SEVERITY.
+const wrapperEnvPrefix = "HAPROXY_WRAPPER_"
+
+// Flag with the path to the wrapper configuration file, it cannot be set in
+// the file itself
+const wrapperConfigFlag = "wrapper-config"
+
+func flagEnvName(name string) string {
+	return wrapperEnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// parseWrapperConfig reads a wrapper configuration file, a mapping of flag
+// names to values or lists of values, in JSON if its extension is .json, or
+// in YAML otherwise.
+func parseWrapperConfig(path string) (map[string][]string, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".json" {
+		return parseWrapperConfigJSON(d)
+	}
+	return parseWrapperConfigYAML(d)
+}
+
+func parseWrapperConfigJSON(d []byte) (map[string][]string, error) {
+	// Numbers are kept as written, as float64 values could be formatted
+	// with exponents
+	var document map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(d))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]string)
+	for name, value := range document {
+		list, isList := value.([]interface{})
+		if !isList {
+			list = []interface{}{value}
+		}
+		for _, v := range list {
+			switch v := v.(type) {
+			case string:
+				values[name] = append(values[name], v)
+			case json.Number:
+				values[name] = append(values[name], v.String())
+			case bool:
+				values[name] = append(values[name], fmt.Sprintf("%v", v))
+			default:
+				return nil, fmt.Errorf("incorrect value for %s, scalars or lists of scalars expected", name)
+			}
+		}
+	}
+	return values, nil
+}
+
+// parseWrapperConfigYAML parses the subset of YAML needed for wrapper
+// configuration files: a mapping of names to scalars, or to lists in block
+// ("- value" lines) or flow ("[a, b]") style. Other YAML features are
+// rejected instead of being read as plain strings.
+func parseWrapperConfigYAML(d []byte) (map[string][]string, error) {
+	values := make(map[string][]string)
+	var listName string
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for n := 1; scanner.Scan(); n++ {
+		line := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if len(listName) == 0 {
+				return nil, fmt.Errorf("line %d: list item out of a list", n)
+			}
+			value, err := yamlScalar(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			values[listName] = append(values[listName], value)
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested mappings not supported", n)
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: \"name: value\" expected", n)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, found := values[name]; found {
+			return nil, fmt.Errorf("line %d: %s is repeated", n, name)
+		}
+		listName = ""
+		switch {
+		case len(value) == 0:
+			// Block list in the following lines
+			listName = name
+			values[name] = []string{}
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("line %d: unterminated list", n)
+			}
+			values[name] = []string{}
+			for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ",") {
+				item = strings.TrimSpace(item)
+				if len(item) == 0 {
+					continue
+				}
+				v, err := yamlScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", n, err)
+				}
+				values[name] = append(values[name], v)
+			}
+		default:
+			v, err := yamlScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			values[name] = []string{v}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// stripYAMLComment removes comments out of quoted strings
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string: %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.IndexAny(s, "{&*!|>%@`") == 0:
+		// Flow mappings, anchors, aliases, tags, block scalars and
+		// reserved indicators are not supported
+		return "", fmt.Errorf("unsupported value: %s", s)
+	}
+	return s, nil
+}
+
+type wrapperConfigHandler struct {
+	names []string
+	apply func() error
+}
+
+// WrapperReloadResult reports the settings changed by a reload of the wrapper
+// configuration.
+type WrapperReloadResult struct {
+	Changed         []string `json:"changed"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// WrapperConfig applies the settings of the wrapper configuration file, and
+// of environment variables, to the flags not set in the command line. Command
+// line has precedence over environment variables, and these over the file.
+// When reloaded, changes in the file are applied to the flags and passed to
+// the handlers of the settings that can change at runtime.
+type WrapperConfig struct {
+	sync.Mutex
+
+	flags    *flag.FlagSet
+	path     string
+	fixed    map[string]bool
+	values   map[string][]string
+	handlers []wrapperConfigHandler
+
+	// Values when the wrapper was started, to know which settings changed
+	// since then can only be applied with a restart
+	initial         map[string][]string
+	restartRequired []string
+	lastReload      time.Time
+	lastError       string
+}
+
+// NewWrapperConfig applies environment variables and the configuration file
+// set in -wrapper-config, if any, to the flags, it has to be called after
+// parsing them.
+func NewWrapperConfig(flags *flag.FlagSet) (*WrapperConfig, error) {
+	c := &WrapperConfig{
+		flags:  flags,
+		fixed:  make(map[string]bool),
+		values: make(map[string][]string),
+	}
+	flags.Visit(func(f *flag.Flag) {
+		c.fixed[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, found := os.LookupEnv(flagEnvName(f.Name))
+		if err != nil || c.fixed[f.Name] || !found {
+			return
+		}
+		values := []string{value}
+		if _, isList := f.Value.(*stringListFlag); isList {
+			values = strings.Split(value, ",")
+		}
+		if setErr := setFlagValues(f, values); setErr != nil {
+			err = fmt.Errorf("incorrect value in %s: %v", flagEnvName(f.Name), setErr)
+		}
+		c.fixed[f.Name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f := flags.Lookup(wrapperConfigFlag); f != nil {
+		c.path = f.Value.String()
+	}
+	if len(c.path) == 0 {
+		return c, nil
+	}
+	values, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range values {
+		if err := setFlagValues(flags.Lookup(name), v); err != nil {
+			return nil, fmt.Errorf("incorrect value for %s in %s: %v", name, c.path, err)
+		}
+	}
+	c.values = values
+	c.initial = values
+	return c, nil
+}
+
+// load reads the configuration file, ignoring the settings fixed in the
+// command line or environment.
+func (c *WrapperConfig) load() (map[string][]string, error) {
+	values, err := parseWrapperConfig(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read wrapper configuration: %v", err)
+	}
+	for name := range values {
+		if name == wrapperConfigFlag || c.flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown setting in %s: %s", c.path, name)
+		}
+		if c.fixed[name] {
+			delete(values, name)
+		}
+	}
+	return values, nil
+}
+
+// setFlagValues sets the value of a flag, settings missing in the file are
+// passed as empty values and restore the default.
+func setFlagValues(f *flag.Flag, values []string) error {
+	if list, isList := f.Value.(*stringListFlag); isList {
+		*list = nil
+		for _, v := range values {
+			if err := list.Set(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch len(values) {
+	case 0:
+		return f.Value.Set(f.DefValue)
+	case 1:
+		return f.Value.Set(values[0])
+	default:
+		return fmt.Errorf("only one value expected")
+	}
+}
+
+// OnChange registers a function to apply changes in the given settings, it is
+// called after the flags are updated. If it fails, the previous values of the
+// flags are restored.
+func (c *WrapperConfig) OnChange(names []string, apply func() error) {
+	c.Lock()
+	defer c.Unlock()
+	c.handlers = append(c.handlers, wrapperConfigHandler{names: names, apply: apply})
+}
+
+// Reload reads the configuration file again and applies the changes
+func (c *WrapperConfig) Reload() (WrapperReloadResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	result := WrapperReloadResult{Changed: []string{}, Applied: []string{}}
+	err := c.reload(&result)
+	c.lastReload = time.Now()
+	c.lastError = ""
+	if err != nil {
+		result.Error = err.Error()
+		c.lastError = result.Error
+	}
+	return result, err
+}
+
+func (c *WrapperConfig) reload(result *WrapperReloadResult) error {
+	if len(c.path) == 0 {
+		return nil
+	}
+	values, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string]bool)
+	for name := range values {
+		if !sameValues(values[name], c.values[name]) {
+			changed[name] = true
+		}
+	}
+	for name := range c.values {
+		if !sameValues(values[name], c.values[name]) {
+			changed[name] = true
+		}
+	}
+	// Only settings that can be applied at runtime are updated, the rest
+	// keep the values used by running components till the next restart
+	handled := make(map[string]bool)
+	for _, h := range c.handlers {
+		for _, name := range h.names {
+			handled[name] = true
+		}
+	}
+	for name := range changed {
+		result.Changed = append(result.Changed, name)
+		if !handled[name] {
+			continue
+		}
+		if err := setFlagValues(c.flags.Lookup(name), values[name]); err != nil {
+			// Restore the flags already changed
+			for name := range changed {
+				if handled[name] {
+					setFlagValues(c.flags.Lookup(name), c.values[name])
+				}
+			}
+			result.Changed = []string{}
+			return fmt.Errorf("incorrect value for %s: %v", name, err)
+		}
+	}
+	sort.Strings(result.Changed)
+
+	var errs []string
+	for _, h := range c.handlers {
+		var names []string
+		for _, name := range h.names {
+			if changed[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		if err := h.apply(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", strings.Join(names, ", "), err))
+			// Keep the previous values, so they are applied again in
+			// the next reload
+			for _, name := range names {
+				setFlagValues(c.flags.Lookup(name), c.values[name])
+				values[name] = c.values[name]
+			}
+			continue
+		}
+		result.Applied = append(result.Applied, names...)
+	}
+	sort.Strings(result.Applied)
+
+	for _, name := range result.Changed {
+		if !handled[name] {
+			log.Printf("Setting %s changed in %s, it requires a restart to be applied\n", name, c.path)
+		}
+	}
+	c.restartRequired = nil
+	names := make(map[string]bool)
+	for name := range values {
+		names[name] = true
+	}
+	for name := range c.initial {
+		names[name] = true
+	}
+	for name := range names {
+		if !handled[name] && !sameValues(values[name], c.initial[name]) {
+			c.restartRequired = append(c.restartRequired, name)
+		}
+	}
+	sort.Strings(c.restartRequired)
+	result.RestartRequired = c.restartRequired
+
+	c.values = values
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't apply settings: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sameValues compares values of settings, missing settings and empty lists
+// are equivalent, both restore the default value.
+func sameValues(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (c *WrapperConfig) Status() interface{} {
+	c.Lock()
+	defer c.Unlock()
+	return map[string]interface{}{
+		"path":             c.path,
+		"last_reload":      c.lastReload,
+		"last_error":       c.lastError,
+		"restart_required": c.restartRequired,
+	}
+}
+
+// ServeHTTP reloads the wrapper configuration on POST requests
+func (c *WrapperConfig) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Wrapper configuration is reloaded with POST requests\n", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := c.Reload()
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("Couldn't reload wrapper configuration: %v\n", err)
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, result)
+}
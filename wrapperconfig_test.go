@@ -0,0 +1,196 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseWrapperConfigYAML(t *testing.T) {
+	config := `---
+# Wrapper settings
+syslog-min-severity: warning
+syslog-tags: "haproxy, lb"  # quoted
+webhook-url:
+  - http://hooks.example.com/a
+  - 'http://hooks.example.com/#b'
+control-address: [127.0.0.1:15000, "unix:///run/control.sock"]
+strict-validation: true
+`
+	values, err := parseWrapperConfigYAML([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"syslog-min-severity": {"warning"},
+		"syslog-tags":         {"haproxy, lb"},
+		"webhook-url":         {"http://hooks.example.com/a", "http://hooks.example.com/#b"},
+		"control-address":     {"127.0.0.1:15000", "unix:///run/control.sock"},
+		"strict-validation":   {"true"},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("%v expected, found %v", expected, values)
+	}
+
+	for _, incorrect := range []string{
+		"- item\n",
+		"syslog:\n  tags: haproxy\n",
+		"syslog-tags haproxy\n",
+		"syslog-tags: a\nsyslog-tags: b\n",
+		"syslog-tags: 'unterminated\n",
+		"webhook-url: |\n",
+		"webhook-url: >-\n",
+		"syslog-tags: &tags haproxy\n",
+		"syslog-tags: !!str haproxy\n",
+		"syslog-tags: [*tags]\n",
+	} {
+		if _, err := parseWrapperConfigYAML([]byte(incorrect)); err == nil {
+			t.Errorf("error expected parsing %q", incorrect)
+		}
+	}
+}
+
+func TestParseWrapperConfigJSON(t *testing.T) {
+	config := `{"syslog-port": 1514, "webhook-queue-size": 1000000, "watch-config": true, "webhook-url": ["http://a", "http://b"]}`
+	values, err := parseWrapperConfigJSON([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"syslog-port":        {"1514"},
+		"webhook-queue-size": {"1000000"},
+		"watch-config":       {"true"},
+		"webhook-url":        {"http://a", "http://b"},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("%v expected, found %v", expected, values)
+	}
+
+	if _, err := parseWrapperConfigJSON([]byte(`{"syslog": {"port": 1514}}`)); err == nil {
+		t.Fatal("error expected with nested objects")
+	}
+}
+
+type testWrapperFlags struct {
+	flags                          *flag.FlagSet
+	severity, tags, secret, config string
+	port                           uint
+	urls                           stringListFlag
+}
+
+func newTestWrapperFlags(args ...string) (*testWrapperFlags, error) {
+	f := &testWrapperFlags{flags: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.flags.StringVar(&f.config, wrapperConfigFlag, "", "")
+	f.flags.StringVar(&f.severity, "syslog-min-severity", "debug", "")
+	f.flags.StringVar(&f.tags, "syslog-tags", "", "")
+	f.flags.StringVar(&f.secret, "webhook-secret-file", "", "")
+	f.flags.UintVar(&f.port, "syslog-port", 514, "")
+	f.flags.Var(&f.urls, "webhook-url", "")
+	return f, f.flags.Parse(args)
+}
+
+func TestWrapperConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapperconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wrapper.yaml")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("syslog-min-severity: err\nsyslog-tags: haproxy\nsyslog-port: 1514\nwebhook-url: [http://a]\n")
+
+	os.Setenv(flagEnvName("syslog-tags"), "lb")
+	defer os.Unsetenv(flagEnvName("syslog-tags"))
+
+	f, err := newTestWrapperFlags("-wrapper-config", path, "-webhook-secret-file", "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewWrapperConfig(f.flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Command line over environment over file
+	if f.severity != "err" || f.tags != "lb" || f.port != 1514 || f.secret != "/secret" || !reflect.DeepEqual([]string(f.urls), []string{"http://a"}) {
+		t.Fatalf("unexpected settings: %+v", f)
+	}
+
+	var applied []string
+	config.OnChange([]string{"webhook-url", "webhook-secret-file"}, func() error {
+		applied = append(applied, f.urls.String())
+		return nil
+	})
+	failing := true
+	config.OnChange([]string{"syslog-min-severity", "syslog-tags"}, func() error {
+		if failing {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+
+	write("syslog-min-severity: crit\nsyslog-tags: haproxy\nwebhook-url: [http://a, http://b]\nwebhook-secret-file: /other\n")
+	result, err := config.Reload()
+	if err == nil {
+		t.Fatal("error expected when a change cannot be applied")
+	}
+	if !reflect.DeepEqual(result.Changed, []string{"syslog-min-severity", "syslog-port", "webhook-url"}) {
+		t.Fatalf("unexpected changes: %v", result.Changed)
+	}
+	// Settings fixed in command line or environment are not changed
+	if f.secret != "/secret" || f.tags != "lb" {
+		t.Fatalf("settings fixed in command line or environment changed: %+v", f)
+	}
+	if !reflect.DeepEqual(applied, []string{"http://a,http://b"}) {
+		t.Fatalf("webhooks change not applied: %v", applied)
+	}
+	// Failed changes are reverted
+	if f.severity != "err" {
+		t.Fatalf("failed change expected to be reverted, found %s", f.severity)
+	}
+	// Settings that cannot be applied at runtime are not changed
+	if f.port != 1514 || !reflect.DeepEqual(result.RestartRequired, []string{"syslog-port"}) {
+		t.Fatalf("port expected to be kept and require a restart, found %d, %v", f.port, result.RestartRequired)
+	}
+
+	// Failed changes are retried in next reload
+	failing = false
+	write("syslog-min-severity: crit\nsyslog-port: 1514\nwebhook-url: [http://a, http://b]\n")
+	result, err = config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.severity != "crit" || !reflect.DeepEqual(result.Applied, []string{"syslog-min-severity"}) {
+		t.Fatalf("change expected to be applied, found %s, %v", f.severity, result.Applied)
+	}
+	if len(result.RestartRequired) != 0 {
+		t.Fatalf("no restart expected after restoring initial values, found %v", result.RestartRequired)
+	}
+
+	write("unknown-setting: 1\n")
+	if _, err := config.Reload(); err == nil {
+		t.Fatal("error expected with unknown settings")
+	}
+}